@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// CacheEntry is what was known about a local file the last time it was synced
+type CacheEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Inode   uint64    `json:"inode"`
+	// ETag is the checksum of the file in the same form as the ETag of the s3 object it was compared with
+	ETag string `json:"etag"`
+	// PartSize is the part size the ETag was calculated with, 0 for a plain md5
+	PartSize int64 `json:"part_size,omitempty"`
+	// RemoteETag is the ETag of the s3 object the file was compared with
+	RemoteETag string `json:"remote_etag,omitempty"`
+}
+
+// matches returns true if the file hasn't changed since the entry was cached
+func (e *CacheEntry) matches(file *FileStat) bool {
+	return e.Size == file.Size && e.ModTime.Equal(file.ModTime) && e.Inode == file.Inode
+}
+
+// StateCache is an on-disk index of local files and their checksums, so that files that haven't changed since the
+// last run don't need to be hashed again. Files are keyed by their absolute path.
+type StateCache struct {
+	path    string
+	entries map[string]*CacheEntry
+
+	mu    sync.Mutex
+	files []*FileStat
+}
+
+// loadStateCache reads the cache from path. A cache that doesn't exist or can't be read is treated as empty, and if
+// rebuild is true the content of the file is ignored.
+func loadStateCache(path string, rebuild bool, logger *Logger) *StateCache {
+	cache := &StateCache{
+		path:    path,
+		entries: make(map[string]*CacheEntry),
+	}
+	if rebuild {
+		logger.Debug.Printf("rebuilding cache %s\n", path)
+		return cache
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cache
+	}
+	if err != nil {
+		logger.Err.Printf("Could not read cache, it will be rebuilt: %v\n", err)
+		return cache
+	}
+	if err := json.Unmarshal(data, &cache.entries); err != nil {
+		logger.Err.Printf("Could not parse cache %s, it will be rebuilt: %v\n", path, err)
+		cache.entries = make(map[string]*CacheEntry)
+	}
+	logger.Debug.Printf("loaded %d entries from cache %s\n", len(cache.entries), path)
+	return cache
+}
+
+// lookup fills in the checksum for a local file if it hasn't changed since it was cached, and remembers the file so its
+// checksum can be saved at the end of the run. It's safe to call on a nil StateCache.
+func (c *StateCache) lookup(file *FileStat) {
+	if c == nil {
+		return
+	}
+	if entry, ok := c.entries[file.Path]; ok {
+		if entry.matches(file) {
+			file.Checksum = entry.ETag
+			file.ChecksumPartSize = entry.PartSize
+			file.RemoteETag = entry.RemoteETag
+		}
+	}
+	c.mu.Lock()
+	c.files = append(c.files, file)
+	c.mu.Unlock()
+}
+
+// save atomically replaces the cache file with the checksums of the files seen during this run. Entries of files that
+// weren't hashed during this run, e.g. because it didn't use -checksum, are kept unless the file has changed. It must
+// only be called after all files have been compared. It's safe to call on a nil StateCache.
+func (c *StateCache) save() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := make(map[string]*CacheEntry, len(c.entries))
+	for path, entry := range c.entries {
+		entries[path] = entry
+	}
+	for _, file := range c.files {
+		if file.Checksum == "" {
+			if entry, ok := entries[file.Path]; ok && !entry.matches(file) {
+				delete(entries, file.Path)
+			}
+			continue
+		}
+		entries[file.Path] = &CacheEntry{
+			Size:       file.Size,
+			ModTime:    file.ModTime,
+			Inode:      file.Inode,
+			ETag:       file.Checksum,
+			PartSize:   file.ChecksumPartSize,
+			RemoteETag: file.RemoteETag,
+		}
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file and rename it, so that an interrupted run never leaves a half written cache
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStateCache(t *testing.T) {
+	logger, buf := getTestLogger()
+	dir, err := ioutil.TempDir("", "s3sync-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	path := filepath.Join(dir, "cache.json")
+	now := time.Now()
+
+	cache := loadStateCache(path, false, logger)
+	cache.lookup(&FileStat{Path: "/var/www/a.html", Size: 1, ModTime: now, Inode: 1, Checksum: "aaa"})
+	cache.lookup(&FileStat{Path: "/var/www/b.html", Size: 1, ModTime: now, Inode: 2})
+	cache.lookup(&FileStat{Path: "/var/www/c.bin", Size: 1, ModTime: now, Inode: 4, Checksum: "ccc-1", ChecksumPartSize: 5})
+	if err := cache.save(); err != nil {
+		t.Fatalf("unexpected error saving cache: %v", err)
+	}
+
+	tests := []struct {
+		file     *FileStat
+		expected string
+	}{
+		{file: &FileStat{Path: "/var/www/a.html", Size: 1, ModTime: now, Inode: 1}, expected: "aaa"},
+		{file: &FileStat{Path: "/var/www/a.html", Size: 2, ModTime: now, Inode: 1}, expected: ""},
+		{file: &FileStat{Path: "/var/www/a.html", Size: 1, ModTime: now.Add(time.Second), Inode: 1}, expected: ""},
+		{file: &FileStat{Path: "/var/www/a.html", Size: 1, ModTime: now, Inode: 3}, expected: ""},
+		{file: &FileStat{Path: "/var/www/b.html", Size: 1, ModTime: now, Inode: 2}, expected: ""},
+	}
+	cache = loadStateCache(path, false, logger)
+	for _, test := range tests {
+		cache.lookup(test.file)
+		if test.file.Checksum != test.expected {
+			t.Errorf("lookup(%s) gave checksum %q, want %q", test.file, test.file.Checksum, test.expected)
+		}
+	}
+	multipart := &FileStat{Path: "/var/www/c.bin", Size: 1, ModTime: now, Inode: 4}
+	cache.lookup(multipart)
+	if multipart.Checksum != "ccc-1" || multipart.ChecksumPartSize != 5 {
+		t.Errorf("Expected the checksum and its part size from the cache, got %q and %d", multipart.Checksum, multipart.ChecksumPartSize)
+	}
+
+	cache = loadStateCache(path, true, logger)
+	file := &FileStat{Path: "/var/www/a.html", Size: 1, ModTime: now, Inode: 1}
+	cache.lookup(file)
+	if file.Checksum != "" {
+		t.Errorf("Expected a rebuilt cache to be empty, got checksum %q", file.Checksum)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cache = loadStateCache(path, false, logger)
+	if len(cache.entries) != 0 {
+		t.Errorf("Expected a broken cache to be empty, got %d entries", len(cache.entries))
+		t.Errorf("%s\n", buf)
+	}
+}
+
+func TestStateCacheKeepsChecksums(t *testing.T) {
+	logger, _ := getTestLogger()
+	dir, err := ioutil.TempDir("", "s3sync-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	path := filepath.Join(dir, "cache.json")
+	now := time.Now()
+
+	cache := loadStateCache(path, false, logger)
+	cache.lookup(&FileStat{Path: "/var/www/a.html", Size: 1, ModTime: now, Inode: 1, Checksum: "aaa", RemoteETag: "aaa"})
+	cache.lookup(&FileStat{Path: "/var/www/b.html", Size: 1, ModTime: now, Inode: 2, Checksum: "bbb"})
+	if err := cache.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a run that doesn't calculate checksums and doesn't see a.html keeps it, b.html has changed and is removed
+	cache = loadStateCache(path, false, logger)
+	cache.lookup(&FileStat{Path: "/var/www/b.html", Size: 2, ModTime: now, Inode: 2})
+	if err := cache.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	cache = loadStateCache(path, false, logger)
+	a := &FileStat{Path: "/var/www/a.html", Size: 1, ModTime: now, Inode: 1}
+	cache.lookup(a)
+	if a.Checksum != "aaa" || a.RemoteETag != "aaa" {
+		t.Errorf("Expected the checksum and remote ETag to be kept, got %q and %q", a.Checksum, a.RemoteETag)
+	}
+	if _, ok := cache.entries["/var/www/b.html"]; ok {
+		t.Error("Expected the entry of the changed file to be removed")
+	}
+}
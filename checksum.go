@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// awsCliPartSize is the default multipart chunk size of the aws cli, objects uploaded with it have ETags with this
+// part size
+const awsCliPartSize int64 = 8 * 1024 * 1024
+
+// checksumStrategy syncs a file if the size is different or the content is different. The content is compared by
+// calculating the ETag s3 would have given the local file, and compare that to the ETag of the s3 object. For objects
+// uploaded as multipart the ETag is the md5 of the md5 of each part followed by the number of parts, so we need to
+// know the part size that was used when it was uploaded. The ETags of objects encrypted with KMS or customer keys
+// can't be compared, for those the modified times are compared like the defaultStrategy does. Objects encrypted by
+// s3sync are compared with the HMAC of the plaintext in their metadata, which needs the keys.
+type checksumStrategy struct {
+	partSize    int64
+	opaqueETags bool
+	keys        KeyWrapper
+}
+
+func (s checksumStrategy) ShouldSync(source, dest *FileStat) (bool, string) {
+	if dest == nil {
+		return true, "file does not exist at destination"
+	}
+	if source.Size != dest.Size {
+		return true, fmt.Sprintf("size %d -> %d", source.Size, dest.Size)
+	}
+	if local, remote := localAndEncrypted(source, dest); remote != nil {
+		return s.compareEncrypted(local, remote)
+	}
+	if !s.comparable(source) || !s.comparable(dest) {
+		sync, reason := defaultStrategy{}.ShouldSync(source, dest)
+		return sync, reason + ", the ETags of encrypted objects aren't checksums"
+	}
+	// copies of multipart uploads get a plain md5 from CopyObject or other parts from multipartCopy, so the ETags of
+	// two objects can only be compared when they were uploaded in the same number of parts
+	if source.ETag != "" && dest.ETag != "" && etagParts(source.ETag) != etagParts(dest.ETag) {
+		sync, reason := defaultStrategy{}.ShouldSync(source, dest)
+		return sync, reason + ", the ETags are from uploads in different parts"
+	}
+	sourceSum, destSum, err := s.checksums(source, dest)
+	if err != nil {
+		return true, fmt.Sprintf("could not compare checksums: %s", err)
+	}
+	if sourceSum != destSum {
+		return true, fmt.Sprintf("checksum %s -> %s", sourceSum, destSum)
+	}
+	return false, "same checksum"
+}
+
+// comparable returns true if the checksum of the file is known or can be calculated. Local files can always be
+// read, and compressed objects have the md5 of the original content in their metadata.
+func (s checksumStrategy) comparable(file *FileStat) bool {
+	return !s.opaqueETags || file.ETag == "" || file.Metadata[metaUncompressedMD5] != ""
+}
+
+// compareEncrypted compares a local file with an object encrypted by s3sync, by the HMAC of the plaintext
+func (s checksumStrategy) compareEncrypted(local, remote *FileStat) (bool, string) {
+	if s.keys == nil {
+		sync, reason := defaultStrategy{}.ShouldSync(local, remote)
+		return sync, reason + ", the object is encrypted by s3sync"
+	}
+	same, err := sameContent(local.Path, remote.Metadata, s.keys)
+	if err != nil {
+		return true, fmt.Sprintf("could not compare checksums: %s", err)
+	}
+	if !same {
+		return true, "checksum differs from the encrypted object"
+	}
+	return false, "same checksum"
+}
+
+// localAndEncrypted returns the local file and the object when one of the files is an object encrypted by s3sync and
+// the other a local file, otherwise remote is nil
+func localAndEncrypted(source, dest *FileStat) (local, remote *FileStat) {
+	switch {
+	case encryptedBySync(dest) && source.ETag == "":
+		return source, dest
+	case encryptedBySync(source) && dest.ETag == "":
+		return dest, source
+	}
+	return nil, nil
+}
+
+// checksums returns the ETags for both files, the ETag of s3 objects is known from the listing, but for local files it
+// has to be calculated.
+func (s checksumStrategy) checksums(source, dest *FileStat) (string, string, error) {
+	switch {
+	case source.ETag != "" && dest.ETag != "":
+		return source.ETag, dest.ETag, nil
+	case dest.ETag != "":
+		sum, err := s.localETag(source, dest.ETag)
+		return sum, dest.ETag, err
+	case source.ETag != "":
+		sum, err := s.localETag(dest, source.ETag)
+		return source.ETag, sum, err
+	}
+	return "", "", errors.New("no ETag to compare with")
+}
+
+// localETag calculates the ETag for the local file in the same form as the remoteETag, i.e. a plain md5 or a multipart
+// ETag with the same number of parts. The result is kept in file.Checksum, and if that's already set from the cache
+// with the same part size the file isn't read again.
+func (s checksumStrategy) localETag(file *FileStat, remoteETag string) (string, error) {
+	if file.LinkTarget != "" {
+		// links are uploaded as empty objects
+		sum := md5.Sum(nil)
+		return hex.EncodeToString(sum[:]), nil
+	}
+	if file.Checksum != "" && file.RemoteETag == remoteETag {
+		// calculated to compare with the same object, so in the same form
+		return file.Checksum, nil
+	}
+	var partSize int64
+	if parts := etagParts(remoteETag); parts > 0 {
+		partSize = guessPartSize(file.Size, parts, s.partSize)
+		if partSize == 0 {
+			return "", fmt.Errorf("unknown part size for ETag %s", remoteETag)
+		}
+	}
+	if file.Checksum != "" && file.ChecksumPartSize == partSize {
+		file.RemoteETag = remoteETag
+		return file.Checksum, nil
+	}
+	sum, err := fileETag(file.Path, partSize)
+	if err != nil {
+		return "", err
+	}
+	file.Checksum = sum
+	file.ChecksumPartSize = partSize
+	file.RemoteETag = remoteETag
+	return sum, nil
+}
+
+// etagParts returns the number of parts in a multipart ETag, or 0 if it's not a multipart ETag
+func etagParts(etag string) int64 {
+	idx := strings.LastIndex(etag, "-")
+	if idx < 0 {
+		return 0
+	}
+	parts, err := strconv.ParseInt(etag[idx+1:], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return parts
+}
+
+// guessPartSize tries to figure out what part size that was used for uploading a file of size in a number of parts.
+// It tries the configured part size, the default for s3manager and the aws cli and finally the smallest whole number
+// of MB that gives the right number of parts. It returns 0 if no part size fits.
+func guessPartSize(size, parts, partSize int64) int64 {
+	const mb = 1024 * 1024
+	candidates := []int64{partSize, s3manager.DefaultUploadPartSize, awsCliPartSize, (size/parts + mb - 1) / mb * mb}
+	for _, candidate := range candidates {
+		if candidate <= 0 {
+			continue
+		}
+		// s3manager increases the part size if the file would have more parts than allowed
+		if size/candidate >= s3manager.MaxUploadParts {
+			candidate = size/s3manager.MaxUploadParts + 1
+		}
+		if (size+candidate-1)/candidate == parts {
+			return candidate
+		}
+	}
+	return 0
+}
+
+// fileETag calculates the ETag s3 gives a file uploaded in parts of partSize. If partSize is 0 the file was uploaded
+// in one request, and the ETag is the hex encoded md5 of the content. Otherwise it's the md5 of all the part md5s
+// followed by a dash and the number of parts, also when the file fits in one part.
+func fileETag(path string, partSize int64) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	if partSize <= 0 {
+		hash := md5.New()
+		if _, err := io.Copy(hash, file); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(hash.Sum(nil)), nil
+	}
+
+	var sums []byte
+	var parts int
+	for {
+		hash := md5.New()
+		n, err := io.CopyN(hash, file, partSize)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		if n > 0 || parts == 0 {
+			sums = append(sums, hash.Sum(nil)...)
+			parts++
+		}
+		if n < partSize {
+			break
+		}
+	}
+	sum := md5.Sum(sums)
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), parts), nil
+}
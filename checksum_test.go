@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFileETag(t *testing.T) {
+	file, err := ioutil.TempFile("", "s3sync-etag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Remove(file.Name())
+	}()
+	content := []byte("0123456789")
+	if _, err := file.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sum := func(b []byte) []byte {
+		s := md5.Sum(b)
+		return s[:]
+	}
+	single := hex.EncodeToString(sum(content))
+	onePart := fmt.Sprintf("%s-1", hex.EncodeToString(sum(sum(content))))
+	var partSums []byte
+	partSums = append(partSums, sum(content[0:4])...)
+	partSums = append(partSums, sum(content[4:8])...)
+	partSums = append(partSums, sum(content[8:10])...)
+	multi := fmt.Sprintf("%s-3", hex.EncodeToString(sum(partSums)))
+
+	var evenSums []byte
+	evenSums = append(evenSums, sum(content[0:5])...)
+	evenSums = append(evenSums, sum(content[5:10])...)
+	even := fmt.Sprintf("%s-2", hex.EncodeToString(sum(evenSums)))
+
+	tests := []struct {
+		partSize int64
+		expected string
+	}{
+		{partSize: 0, expected: single},
+		{partSize: 10, expected: onePart},
+		{partSize: 100, expected: onePart},
+		{partSize: 4, expected: multi},
+		{partSize: 5, expected: even},
+	}
+
+	for _, test := range tests {
+		actual, err := fileETag(file.Name(), test.partSize)
+		if err != nil {
+			t.Errorf("fileETag with part size %d returned unexpected error %v", test.partSize, err)
+			continue
+		}
+		if actual != test.expected {
+			t.Errorf("fileETag with part size %d => %s, want %s", test.partSize, actual, test.expected)
+		}
+	}
+}
+
+func TestGuessPartSize(t *testing.T) {
+	const mb = 1024 * 1024
+	tests := []struct {
+		size     int64
+		parts    int64
+		partSize int64
+		expected int64
+	}{
+		{size: 12 * mb, parts: 3, partSize: 5 * mb, expected: 5 * mb},
+		{size: 12 * mb, parts: 2, partSize: 5 * mb, expected: 8 * mb},
+		{size: 100 * mb, parts: 4, partSize: 5 * mb, expected: 25 * mb},
+		{size: 12 * mb, parts: 3, partSize: 16 * mb, expected: 5 * mb},
+		{size: 10 * mb, parts: 100, partSize: 5 * mb, expected: 0},
+	}
+	for _, test := range tests {
+		if actual := guessPartSize(test.size, test.parts, test.partSize); actual != test.expected {
+			t.Errorf("guessPartSize(%d, %d, %d) => %d, want %d", test.size, test.parts, test.partSize, actual, test.expected)
+		}
+	}
+}
+
+func TestChecksumStrategy(t *testing.T) {
+	strategy := checksumStrategy{partSize: 5}
+	local := &FileStat{Name: "file_33.html", Path: "./_testdata/file_33.html", Size: 34}
+	sum, err := fileETag(local.Path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sync, reason := strategy.ShouldSync(local, &FileStat{Name: "file_33.html", Size: 34, ETag: sum}); sync {
+		t.Errorf("Expected same content to not sync, got %s", reason)
+	}
+	if sync, _ := strategy.ShouldSync(local, &FileStat{Name: "file_33.html", Size: 34, ETag: "d41d8cd98f00b204e9800998ecf8427e"}); !sync {
+		t.Error("Expected different content to sync")
+	}
+	// downloading, the remote object is the source
+	if sync, reason := strategy.ShouldSync(&FileStat{Name: "file_33.html", Size: 34, ETag: sum}, local); sync {
+		t.Errorf("Expected same content to not sync, got %s", reason)
+	}
+}
+
+func TestChecksumStrategyCopy(t *testing.T) {
+	strategy := checksumStrategy{partSize: 5}
+	modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	source := &FileStat{Name: "big.zip", Size: 34, ETag: "0123456789abcdef0123456789abcdef-3", ModTime: modTime}
+
+	// the copy of a multipart upload has another ETag, so the modified times decides
+	copied := &FileStat{Name: "big.zip", Size: 34, ETag: "fedcba9876543210fedcba9876543210", ModTime: modTime.Add(time.Hour)}
+	if sync, reason := strategy.ShouldSync(source, copied); sync {
+		t.Errorf("Expected a copy of a multipart upload to not sync, got %s", reason)
+	}
+	copied.ModTime = modTime.Add(-time.Hour)
+	if sync, _ := strategy.ShouldSync(source, copied); !sync {
+		t.Error("Expected an older copy to sync")
+	}
+
+	// ETags in the same form are compared
+	other := &FileStat{Name: "big.zip", Size: 34, ETag: "fedcba9876543210fedcba9876543210-3", ModTime: modTime.Add(time.Hour)}
+	if sync, _ := strategy.ShouldSync(source, other); !sync {
+		t.Error("Expected different content to sync")
+	}
+}
+
+func TestChecksumStrategyPartSize(t *testing.T) {
+	strategy := checksumStrategy{partSize: 17}
+	twoParts, err := fileETag("./_testdata/file_33.html", 17)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a cached checksum with the same number of parts but another part size isn't used
+	local := &FileStat{Name: "file_33.html", Path: "./_testdata/file_33.html", Size: 34, Checksum: "0123456789abcdef0123456789abcdef-2", ChecksumPartSize: 20}
+	if sync, reason := strategy.ShouldSync(local, &FileStat{Name: "file_33.html", Size: 34, ETag: twoParts}); sync {
+		t.Errorf("Expected same content to not sync, got %s", reason)
+	}
+	if local.Checksum != twoParts || local.ChecksumPartSize != 17 {
+		t.Errorf("Expected the checksum to be calculated with the part size 17, got %s and %d", local.Checksum, local.ChecksumPartSize)
+	}
+
+	// a file uploaded in one part has a multipart ETag
+	strategy.partSize = 34
+	onePart, err := fileETag("./_testdata/file_33.html", 34)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local = &FileStat{Name: "file_33.html", Path: "./_testdata/file_33.html", Size: 34}
+	if sync, reason := strategy.ShouldSync(local, &FileStat{Name: "file_33.html", Size: 34, ETag: onePart}); sync || etagParts(onePart) != 1 {
+		t.Errorf("Expected same content uploaded in one part to not sync, got %s for %s", reason, onePart)
+	}
+}
+
+func TestChecksumStrategyOpaqueETags(t *testing.T) {
+	strategy := checksumStrategy{partSize: 5, opaqueETags: true}
+	modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	local := &FileStat{Name: "file_33.html", Path: "./_testdata/file_33.html", Size: 34, ModTime: modTime}
+
+	// the ETag of an encrypted object never matches, so the modified times decides
+	remote := &FileStat{Name: "file_33.html", Size: 34, ETag: "d41d8cd98f00b204e9800998ecf8427e", ModTime: modTime.Add(time.Hour)}
+	if sync, reason := strategy.ShouldSync(local, remote); sync {
+		t.Errorf("Expected an older local file to not sync, got %s", reason)
+	}
+	remote.ModTime = modTime.Add(-time.Hour)
+	if sync, _ := strategy.ShouldSync(local, remote); !sync {
+		t.Error("Expected a newer local file to sync")
+	}
+
+	// compressed objects have the md5 of the content in their metadata
+	sum, err := fileETag(local.Path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote.ETag = sum
+	remote.Metadata = map[string]string{metaUncompressedMD5: sum}
+	if sync, reason := strategy.ShouldSync(local, remote); sync {
+		t.Errorf("Expected same content to not sync, got %s", reason)
+	}
+}
+
+func TestChecksumStrategyClientEncryption(t *testing.T) {
+	keys, _ := newLocalKeyWrapper(bytes.Repeat([]byte{42}, dataKeySize))
+	modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	local := &FileStat{Name: "file_33.html", Path: "./_testdata/file_33.html", Size: 34, ModTime: modTime}
+	content, err := ioutil.ReadFile(local.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, metadata := encryptTestFile(t, content, keys)
+	remote := &FileStat{Name: "file_33.html", Size: 34, ETag: "ciphertext", ModTime: modTime.Add(-time.Hour), Metadata: metadata}
+
+	strategy := checksumStrategy{keys: keys}
+	if sync, reason := strategy.ShouldSync(local, remote); sync {
+		t.Errorf("Expected same content to not sync, got %s", reason)
+	}
+	if sync, reason := strategy.ShouldSync(remote, local); sync {
+		t.Errorf("Expected same content to not sync when downloading, got %s", reason)
+	}
+	_, other := encryptTestFile(t, bytes.ToUpper(content), keys)
+	if sync, _ := strategy.ShouldSync(local, &FileStat{Name: "file_33.html", Size: 34, ETag: "ciphertext", Metadata: other}); !sync {
+		t.Error("Expected different content to sync")
+	}
+
+	// without the keys the modified times decides
+	if sync, _ := (checksumStrategy{}).ShouldSync(local, remote); !sync {
+		t.Error("Expected a newer local file to sync")
+	}
+}
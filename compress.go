@@ -0,0 +1,130 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+// Metadata that is stored on compressed objects, so that they can be compared with the original file
+const (
+	metaUncompressedSize = "uncompressed-size"
+	metaUncompressedMD5  = "uncompressed-md5"
+)
+
+// compressGzip is the only supported compression, brotli would need a library that isn't vendored
+const compressGzip = "gzip"
+
+// validateCompression returns an error for compressions that aren't supported
+func validateCompression(compression string) error {
+	switch compression {
+	case "", compressGzip:
+		return nil
+	case "br", "brotli":
+		return fmt.Errorf("brotli compression isn't supported, use gzip")
+	}
+	return fmt.Errorf("unknown compression '%s', use gzip", compression)
+}
+
+// compressFile compresses the file at path into a temporary file, and returns it together with the size and the hex
+// encoded md5 of the original content. The caller must close and remove the temporary file.
+func compressFile(path string) (*os.File, int64, string, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+
+	out, err := ioutil.TempFile("", "s3sync-gzip-")
+	if err != nil {
+		return nil, 0, "", err
+	}
+	fail := func(err error) (*os.File, int64, string, error) {
+		_ = out.Close()
+		_ = os.Remove(out.Name())
+		return nil, 0, "", err
+	}
+
+	hash := md5.New()
+	// the gzip header has no name or modified time, so compressing the same content always gives the same result, and
+	// a resumed multipart upload gets the same parts
+	zw, err := gzip.NewWriterLevel(out, gzip.BestCompression)
+	if err != nil {
+		return fail(err)
+	}
+	size, err := io.Copy(zw, io.TeeReader(in, hash))
+	if err != nil {
+		return fail(err)
+	}
+	if err := zw.Close(); err != nil {
+		return fail(err)
+	}
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		return fail(err)
+	}
+	return out, size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// applyCompressionMetadata changes the Size and ETag of a remote file that was compressed by s3sync to the size and
+// md5 of the original file, so that it can be compared to the local file
+func applyCompressionMetadata(file *FileStat) {
+	if file.ContentEncoding == "" {
+		return
+	}
+	if size, err := strconv.ParseInt(file.Metadata[metaUncompressedSize], 10, 64); err == nil {
+		file.Size = size
+	}
+	if sum := file.Metadata[metaUncompressedMD5]; sum != "" {
+		file.ETag = sum
+	}
+}
+
+// compressedBySync returns true if the remote file was compressed by s3sync, and should be decompressed when it's
+// downloaded
+func compressedBySync(file *FileStat) bool {
+	_, ok := file.Metadata[metaUncompressedSize]
+	return file.ContentEncoding == compressGzip && ok
+}
+
+// decompressFile replaces the gzip compressed content of the file at path with the decompressed content
+func decompressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+	zr, err := gzip.NewReader(in)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(path + ".gunzip")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// after a successful rename this will fail silently as the file is gone
+		_ = os.Remove(out.Name())
+	}()
+	if _, err := io.Copy(out, zr); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := zr.Close(); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), path)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompressFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3sync-compress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	path := filepath.Join(dir, "site.css")
+	content := []byte(strings.Repeat("body { color: red; }\n", 100))
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	compressed, size, sum, err := compressFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = compressed.Close()
+		_ = os.Remove(compressed.Name())
+	}()
+	expectedSum := md5.Sum(content)
+	if size != int64(len(content)) || sum != hex.EncodeToString(expectedSum[:]) {
+		t.Errorf("compressFile gave size %d and md5 %s, want %d and %x", size, sum, len(content), expectedSum)
+	}
+	data, err := ioutil.ReadAll(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) >= len(content) {
+		t.Errorf("expected the compressed file to be smaller than %d bytes, it's %d bytes", len(content), len(data))
+	}
+
+	// compressing the same content again must give the same bytes, or resumed multipart uploads would be corrupt
+	again, _, _, err := compressFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = again.Close()
+		_ = os.Remove(again.Name())
+	}()
+	againData, _ := ioutil.ReadAll(again)
+	if !bytes.Equal(data, againData) {
+		t.Error("compressing the same file twice gave different results")
+	}
+
+	downloaded := filepath.Join(dir, "downloaded")
+	if err := ioutil.WriteFile(downloaded, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := decompressFile(downloaded); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(downloaded); !bytes.Equal(data, content) {
+		t.Error("decompressFile didn't restore the original content")
+	}
+	if _, err := os.Stat(downloaded + ".gunzip"); !os.IsNotExist(err) {
+		t.Error("expected the temporary file to be removed")
+	}
+}
+
+func TestDecompressFileInvalid(t *testing.T) {
+	file, err := ioutil.TempFile("", "s3sync-compress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Remove(file.Name())
+	}()
+	_, _ = file.WriteString("not gzip content at all")
+	_ = file.Close()
+	if err := decompressFile(file.Name()); err != gzip.ErrHeader {
+		t.Errorf("expected %v, got %v", gzip.ErrHeader, err)
+	}
+	if data, _ := ioutil.ReadFile(file.Name()); string(data) != "not gzip content at all" {
+		t.Error("a failed decompression changed the file")
+	}
+}
+
+func TestApplyCompressionMetadata(t *testing.T) {
+	file := &FileStat{Size: 100, ETag: "compressed", ContentEncoding: "gzip", Metadata: map[string]string{
+		metaUncompressedSize: "2100",
+		metaUncompressedMD5:  "abc",
+	}}
+	applyCompressionMetadata(file)
+	if file.Size != 2100 || file.ETag != "abc" || !compressedBySync(file) {
+		t.Errorf("unexpected file after applying the metadata: %+v", file)
+	}
+
+	plain := &FileStat{Size: 100, ETag: "plain", Metadata: map[string]string{}}
+	applyCompressionMetadata(plain)
+	if plain.Size != 100 || plain.ETag != "plain" || compressedBySync(plain) {
+		t.Errorf("unexpected file after applying the metadata: %+v", plain)
+	}
+}
+
+func TestValidateCompression(t *testing.T) {
+	for compression, valid := range map[string]bool{"": true, "gzip": true, "br": false, "zip": false} {
+		if err := validateCompression(compression); (err == nil) != valid {
+			t.Errorf("validateCompression(%q) gave %v", compression, err)
+		}
+	}
+	rules := &ObjectRules{}
+	flag := &ruleFlag{rules: rules, set: func(r *ObjectRule, v string) { r.Compress = v }, implicit: compressGzip}
+	if err := flag.Set("*.css"); err != nil {
+		t.Fatal(err)
+	}
+	if err := flag.Set("*.js=br"); err == nil {
+		t.Error("expected an error for brotli compression")
+	}
+	if len(rules.rules) != 1 || rules.rules[0].Pattern != "*.css" || rules.rules[0].Compress != "gzip" {
+		t.Errorf("unexpected rules %+v", rules.rules)
+	}
+}
+
+func TestShouldSyncCompression(t *testing.T) {
+	rules := &ObjectRules{}
+	rules.add(&ObjectRule{Pattern: "*.css", Compress: compressGzip})
+	if err := rules.compile(globOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{Mode: Upload, Rules: rules}
+	source := &FileStat{Name: "site.css", Size: 10}
+
+	tests := []struct {
+		dest     *FileStat
+		expected bool
+	}{
+		// not fetched with HeadObject, so the strategy decides
+		{dest: &FileStat{Name: "site.css", Size: 10}, expected: false},
+		{dest: &FileStat{Name: "site.css", Size: 10, ContentEncoding: "gzip", Metadata: map[string]string{}}, expected: false},
+		{dest: &FileStat{Name: "site.css", Size: 10, Metadata: map[string]string{}}, expected: true},
+	}
+	for _, test := range tests {
+		if sync, reason := shouldSync(config, sizeOnlyStrategy{}, source, test.dest); sync != test.expected {
+			t.Errorf("shouldSync(%+v) => %t (%s), want %t", test.dest, sync, reason, test.expected)
+		}
+	}
+}
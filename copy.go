@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+const (
+	// maxCopyObjectSize is the largest object that can be copied with a single CopyObject call, 5GB
+	maxCopyObjectSize int64 = 5 * 1024 * 1024 * 1024
+	// maxPartSize is the largest part of a multipart upload, and the largest object that can be uploaded with a single
+	// PutObject call, 5GB
+	maxPartSize int64 = 5 * 1024 * 1024 * 1024
+	// copyPartSize is the size of each part when copying larger objects with UploadPartCopy, it's doubled for objects
+	// that would need more parts than a multipart upload can have
+	copyPartSize int64 = 512 * 1024 * 1024
+)
+
+// copyObject copies an object from the config.Source bucket to the destination bucket without the data leaving s3
+func copyObject(config *Config, fileStat *FileStat, logger *Logger) error {
+
+	logger.Debug.Printf("will copy s3://%s/%s to s3://%s/%s\n", config.Source.Bucket, fileStat.Path, config.Bucket, config.BucketPrefix)
+
+	key := objectKey(config.BucketPrefix, fileStat.Name)
+
+	if config.DryRun {
+		return nil
+	}
+
+	// the copy source header is "bucket/key" and the key needs to be url encoded
+	copySource := config.Source.Bucket + "/" + escapeKey(fileStat.Path)
+
+	props := config.Rules.match(fileStat.Name)
+	var err error
+	if fileStat.Size > maxCopyObjectSize {
+		err = multipartCopy(config, fileStat, props, copySource, key)
+	} else {
+		input := &s3.CopyObjectInput{
+			Bucket:     aws.String(config.Bucket),
+			Key:        aws.String(key),
+			CopySource: aws.String(copySource),
+		}
+		if props.ACL != "" {
+			input.ACL = aws.String(props.ACL)
+		}
+		if props.StorageClass != "" {
+			input.StorageClass = aws.String(props.StorageClass)
+		}
+		config.Encryption.setCopy(input, config.Source.Encryption)
+		_, err = config.S3Service.CopyObject(input)
+	}
+	if err == nil {
+		// the data never passes through here, so the progress is updated when the whole object has been copied
+		config.Progress.transferred(fileStat.Size)
+	}
+	return err
+}
+
+// multipartCopy copies objects larger than 5GB by splitting them into ranges that are copied with UploadPartCopy
+func multipartCopy(config *Config, fileStat *FileStat, props *ObjectRule, copySource, key string) error {
+
+	// CopyObject keeps the headers and metadata of the source object, but for multipart uploads we have to set them
+	headInput := &s3.HeadObjectInput{
+		Bucket: aws.String(config.Source.Bucket),
+		Key:    aws.String(fileStat.Path),
+	}
+	config.Source.Encryption.setHead(headInput)
+	head, err := config.Source.S3Service.HeadObject(headInput)
+	if err != nil {
+		return err
+	}
+
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:             aws.String(config.Bucket),
+		Key:                aws.String(key),
+		CacheControl:       head.CacheControl,
+		ContentDisposition: head.ContentDisposition,
+		ContentEncoding:    head.ContentEncoding,
+		ContentLanguage:    head.ContentLanguage,
+		ContentType:        head.ContentType,
+		Metadata:           head.Metadata,
+	}
+	if head.Expires != nil {
+		if expires, err := http.ParseTime(*head.Expires); err == nil {
+			input.Expires = &expires
+		}
+	}
+	if props.ACL != "" {
+		input.ACL = aws.String(props.ACL)
+	}
+	if props.StorageClass != "" {
+		input.StorageClass = aws.String(props.StorageClass)
+	}
+	config.Encryption.setCreateMultipart(input)
+
+	upload, err := config.S3Service.CreateMultipartUpload(input)
+	if err != nil {
+		return err
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		parts    []*s3.CompletedPart
+		firstErr error
+	)
+	concurrency := config.PartConcurrency
+	if concurrency < 1 {
+		concurrency = s3manager.DefaultUploadConcurrency
+	}
+	sem := make(chan bool, concurrency)
+
+	partSize := copyPartSize
+	for fileStat.Size/partSize >= int64(s3manager.MaxUploadParts) {
+		partSize *= 2
+	}
+	for partNumber, start := int64(1), int64(0); start < fileStat.Size; partNumber, start = partNumber+1, start+partSize {
+		end := start + partSize - 1
+		if end >= fileStat.Size {
+			end = fileStat.Size - 1
+		}
+		sem <- true
+		wg.Add(1)
+		go func(partNumber, start, end int64) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			input := &s3.UploadPartCopyInput{
+				Bucket:          aws.String(config.Bucket),
+				Key:             aws.String(key),
+				CopySource:      aws.String(copySource),
+				CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+				PartNumber:      aws.Int64(partNumber),
+				UploadId:        upload.UploadId,
+			}
+			config.Encryption.setUploadPartCopy(input, config.Source.Encryption)
+			part, err := config.S3Service.UploadPartCopy(input)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			parts = append(parts, &s3.CompletedPart{ETag: part.CopyPartResult.ETag, PartNumber: aws.Int64(partNumber)})
+		}(partNumber, start, end)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		_, _ = config.S3Service.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(config.Bucket),
+			Key:      aws.String(key),
+			UploadId: upload.UploadId,
+		})
+		return firstErr
+	}
+
+	sort.Slice(parts, func(i, j int) bool { return *parts[i].PartNumber < *parts[j].PartNumber })
+	_, err = config.S3Service.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(config.Bucket),
+		Key:             aws.String(key),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	return err
+}
+
+// escapeKey url encodes each part of an object key while keeping the slashes
+func escapeKey(key string) string {
+	parts := strings.Split(key, "/")
+	for i := range parts {
+		parts[i] = url.PathEscape(parts[i])
+	}
+	return strings.Join(parts, "/")
+}
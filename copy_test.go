@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+func TestEscapeKey(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected string
+	}{
+		{"file.html", "file.html"},
+		{"www/assets/file.html", "www/assets/file.html"},
+		{"www/my file.html", "www/my%20file.html"},
+		{"www/a+b?c#d.html", "www/a+b%3Fc%23d.html"},
+	}
+	for _, test := range tests {
+		actual := escapeKey(test.in)
+		if actual != test.expected {
+			t.Errorf("escapeKey(%q) => %q, want %q", test.in, actual, test.expected)
+		}
+	}
+}
+
+// copyMock records the calls made when copying objects between buckets
+type copyMock struct {
+	s3iface.S3API
+	// failPart is the number of the part that UploadPartCopy fails for
+	failPart int64
+
+	mu        sync.Mutex
+	copied    []*s3.CopyObjectInput
+	created   *s3.CreateMultipartUploadInput
+	ranges    map[int64]string
+	completed []*s3.CompletedPart
+	aborted   bool
+}
+
+func (m *copyMock) CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	m.copied = append(m.copied, input)
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (m *copyMock) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	return &s3.HeadObjectOutput{ContentType: aws.String("application/zip"), Metadata: map[string]*string{"Mtime": aws.String("1577836800")}}, nil
+}
+
+func (m *copyMock) CreateMultipartUpload(input *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
+	m.created = input
+	m.ranges = make(map[int64]string)
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload-1")}, nil
+}
+
+func (m *copyMock) UploadPartCopy(input *s3.UploadPartCopyInput) (*s3.UploadPartCopyOutput, error) {
+	if *input.PartNumber == m.failPart {
+		return nil, errors.New("part failed")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ranges[*input.PartNumber] = *input.CopySourceRange
+	return &s3.UploadPartCopyOutput{CopyPartResult: &s3.CopyPartResult{ETag: aws.String(fmt.Sprintf("etag-%d", *input.PartNumber))}}, nil
+}
+
+func (m *copyMock) CompleteMultipartUpload(input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	m.completed = input.MultipartUpload.Parts
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (m *copyMock) AbortMultipartUpload(input *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+	m.aborted = true
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+// copyTestConfig returns a config that copies from s3://source/www to s3://dest/backup
+func copyTestConfig(mock *copyMock) *Config {
+	return &Config{
+		Mode:         Copy,
+		Bucket:       "dest",
+		BucketPrefix: "backup",
+		S3Service:    mock,
+		Source:       &Config{Bucket: "source", BucketPrefix: "www", S3Service: mock},
+	}
+}
+
+func TestCopyObject(t *testing.T) {
+	logger, _ := getTestLogger()
+	mock := &copyMock{}
+	file := &FileStat{Name: "my file.html", Path: "www/my file.html", Size: 10}
+	if err := copyObject(copyTestConfig(mock), file, logger); err != nil {
+		t.Fatal(err)
+	}
+	if len(mock.copied) != 1 || *mock.copied[0].Key != "backup/my file.html" || *mock.copied[0].CopySource != "source/www/my%20file.html" {
+		t.Errorf("expected one copy of source/www/my%%20file.html to backup/my file.html, got %v", mock.copied)
+	}
+	if mock.created != nil {
+		t.Error("expected a small object to be copied without a multipart upload")
+	}
+}
+
+func TestMultipartCopy(t *testing.T) {
+	logger, _ := getTestLogger()
+	mock := &copyMock{}
+	file := &FileStat{Name: "big.zip", Path: "www/big.zip", Size: maxCopyObjectSize + 1}
+	if err := copyObject(copyTestConfig(mock), file, logger); err != nil {
+		t.Fatal(err)
+	}
+	if len(mock.copied) != 0 || mock.created == nil {
+		t.Fatal("expected an object larger than 5GB to be copied with a multipart upload")
+	}
+	// CopyObject would keep the headers, the multipart upload gets them from the source object
+	if *mock.created.Key != "backup/big.zip" || aws.StringValue(mock.created.ContentType) != "application/zip" || aws.StringValue(mock.created.Metadata["Mtime"]) != "1577836800" {
+		t.Errorf("expected the upload to have the headers of the source object, got %v", mock.created)
+	}
+
+	parts := maxCopyObjectSize/copyPartSize + 1
+	if int64(len(mock.completed)) != parts {
+		t.Fatalf("expected %d parts, got %d", parts, len(mock.completed))
+	}
+	for i, part := range mock.completed {
+		if *part.PartNumber != int64(i+1) || *part.ETag != fmt.Sprintf("etag-%d", i+1) {
+			t.Errorf("expected part %d in order, got number %d with %s", i+1, *part.PartNumber, *part.ETag)
+		}
+	}
+	if mock.ranges[1] != fmt.Sprintf("bytes=0-%d", copyPartSize-1) || mock.ranges[parts] != fmt.Sprintf("bytes=%d-%d", maxCopyObjectSize, maxCopyObjectSize) {
+		t.Errorf("unexpected ranges of the first and last part: %s and %s", mock.ranges[1], mock.ranges[parts])
+	}
+
+	// the part size is increased so that the largest objects s3 can store fit in the number of parts
+	mock = &copyMock{}
+	huge := &FileStat{Name: "huge.zip", Path: "www/huge.zip", Size: 5 * 1024 * 1024 * 1024 * 1024}
+	if err := copyObject(copyTestConfig(mock), huge, logger); err != nil {
+		t.Fatal(err)
+	}
+	if len(mock.completed) > s3manager.MaxUploadParts || mock.ranges[int64(len(mock.completed))] != fmt.Sprintf("bytes=%d-%d", 5119*copyPartSize*2, huge.Size-1) {
+		t.Errorf("expected at most %d parts ending with the end of the object, got %d ending with %s", s3manager.MaxUploadParts, len(mock.completed), mock.ranges[int64(len(mock.completed))])
+	}
+
+	// a failed part aborts the upload instead of completing it
+	mock = &copyMock{failPart: 3}
+	if err := copyObject(copyTestConfig(mock), file, logger); err == nil {
+		t.Error("expected the copy to fail")
+	}
+	if !mock.aborted || mock.completed != nil {
+		t.Errorf("expected the upload to be aborted and not completed, got aborted %v", mock.aborted)
+	}
+}
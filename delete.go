@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// maxDeleteObjects is the maximum number of keys that can be deleted with one s3:DeleteObjects call
+const maxDeleteObjects = 1000
+
+// deleteFiles removes files from the destination that doesn't exist in the source anymore. Files that are excluded by
+// the config.Filter are never listed, so they are left alone.
+func deleteFiles(config *Config, toDelete []*FileStat, logger *Logger) {
+
+	if config.Mode == Download {
+		deleteLocalFiles(config, toDelete, logger)
+		return
+	}
+
+	for start := 0; start < len(toDelete); start += maxDeleteObjects {
+		end := start + maxDeleteObjects
+		if end > len(toDelete) {
+			end = len(toDelete)
+		}
+		deleteObjects(config, toDelete[start:end], logger)
+	}
+}
+
+// deleteObjects deletes up to maxDeleteObjects objects from the destination bucket in one call
+func deleteObjects(config *Config, files []*FileStat, logger *Logger) {
+
+	if config.DryRun {
+		for _, file := range files {
+			logger.Event(&Event{Type: EventDelete, DryRun: true, Name: file.Name, Key: "s3://" + path.Join(config.Bucket, file.Path)})
+			config.Summary.deleteResult(nil)
+		}
+		return
+	}
+
+	objects := make([]*s3.ObjectIdentifier, len(files))
+	for i, file := range files {
+		objects[i] = &s3.ObjectIdentifier{Key: aws.String(file.Path)}
+	}
+
+	resp, err := config.S3Service.DeleteObjects(&s3.DeleteObjectsInput{
+		Bucket: aws.String(config.Bucket),
+		Delete: &s3.Delete{Objects: objects},
+	})
+	if err != nil {
+		logger.Event(&Event{Type: EventError, Error: err.Error()})
+		for range files {
+			config.Summary.deleteResult(err)
+		}
+		return
+	}
+
+	for _, deleted := range resp.Deleted {
+		logger.Event(&Event{Type: EventDelete, Key: "s3://" + path.Join(config.Bucket, *deleted.Key)})
+		config.Summary.deleteResult(nil)
+	}
+	for _, failed := range resp.Errors {
+		err := fmt.Errorf("delete failed: s3://%s %s: %s", path.Join(config.Bucket, *failed.Key), *failed.Code, *failed.Message)
+		logger.Event(&Event{Type: EventError, Key: "s3://" + path.Join(config.Bucket, *failed.Key), Error: err.Error()})
+		config.Summary.deleteResult(err)
+	}
+}
+
+// deleteLocalFiles removes local files when downloading
+func deleteLocalFiles(config *Config, files []*FileStat, logger *Logger) {
+	for _, file := range files {
+		if config.DryRun {
+			logger.Event(&Event{Type: EventDelete, DryRun: true, Name: file.Name, LocalPath: file.Path})
+			config.Summary.deleteResult(nil)
+			continue
+		}
+		err := os.Remove(file.Path)
+		config.Summary.deleteResult(err)
+		if err != nil {
+			logger.Event(&Event{Type: EventError, Name: file.Name, LocalPath: file.Path, Error: err.Error()})
+			continue
+		}
+		logger.Event(&Event{Type: EventDelete, Name: file.Name, LocalPath: file.Path})
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// deleteMock deletes every key it's asked to, except the keys in failed
+type deleteMock struct {
+	s3iface.S3API
+	failed  map[string]bool
+	batches []int
+}
+
+func (m *deleteMock) DeleteObjects(input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	m.batches = append(m.batches, len(input.Delete.Objects))
+	out := &s3.DeleteObjectsOutput{}
+	for _, object := range input.Delete.Objects {
+		if m.failed[*object.Key] {
+			out.Errors = append(out.Errors, &s3.Error{Key: object.Key, Code: aws.String("AccessDenied"), Message: aws.String("Access Denied")})
+			continue
+		}
+		out.Deleted = append(out.Deleted, &s3.DeletedObject{Key: object.Key})
+	}
+	return out, nil
+}
+
+func TestDeleteFilesBatches(t *testing.T) {
+	logger, _ := getTestLogger()
+	mock := &deleteMock{failed: map[string]bool{"www/file_1500.html": true}}
+	config := &Config{Mode: Upload, Bucket: "bucket", BucketPrefix: "www", S3Service: mock, Summary: NewSummary()}
+	var files []*FileStat
+	for i := 0; i < 2500; i++ {
+		name := fmt.Sprintf("file_%d.html", i)
+		files = append(files, &FileStat{Name: name, Path: "www/" + name})
+	}
+	deleteFiles(config, files, logger)
+
+	if fmt.Sprint(mock.batches) != "[1000 1000 500]" {
+		t.Errorf("expected the keys to be deleted 1000 at a time, got batches of %v", mock.batches)
+	}
+	if config.Summary.deleted != 2499 || config.Summary.failed != 1 {
+		t.Errorf("expected 2499 deleted and 1 failed, got %d and %d", config.Summary.deleted, config.Summary.failed)
+	}
+}
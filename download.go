@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+func download(config *Config, fileStat *FileStat, logger *Logger) error {
+
+	logger.Debug.Printf("will download s3://%s/%s to %s\n", config.Bucket, fileStat.Path, config.LocalPath)
+
+	target, err := localTarget(config.LocalPath, fileStat.Name)
+	if err != nil {
+		return err
+	}
+
+	if config.DryRun {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	// the content encoding and metadata of the object decides if it's decompressed or decrypted, objects that compare
+	// hasn't fetched with HeadObject are fetched now
+	if fileStat.Metadata == nil {
+		if err := headObject(config, fileStat); err != nil {
+			return err
+		}
+	}
+
+	if link := symlinkTarget(fileStat); link != "" && config.Symlinks == SymlinkMetadata {
+		// links don't have a modified time of their own to set, the object is only the target
+		return createSymlink(config.LocalPath, target, link)
+	}
+
+	// download into a temporary file next to the target so a failed or partial download never replaces a good file
+	file, err := ioutil.TempFile(filepath.Dir(target), ".s3sync-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// after a successful rename this will fail silently as the file is gone
+		_ = os.Remove(file.Name())
+	}()
+
+	// Create a downloader (can do concurrent ranged GETs) with S3 client and the configured part size and concurrency
+	downloader := s3manager.NewDownloaderWithClient(config.S3Service, func(d *s3manager.Downloader) {
+		if config.PartSize > 0 {
+			d.PartSize = config.PartSize
+		}
+		if config.PartConcurrency > 0 {
+			d.Concurrency = config.PartConcurrency
+		}
+	})
+	params := &s3.GetObjectInput{
+		Bucket: aws.String(config.Bucket),
+		Key:    aws.String(fileStat.Path),
+	}
+	config.Encryption.setGet(params)
+
+	var w io.WriterAt = file
+	if config.Progress != nil {
+		w = &progressWriterAt{w: file, progress: config.Progress}
+	}
+
+	if _, err = downloader.Download(w, params); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if encryptedBySync(fileStat) {
+		if err := decryptFile(file.Name(), fileStat.Metadata, config.ClientEncryption); err != nil {
+			return err
+		}
+	}
+	if compressedBySync(fileStat) {
+		if err := decompressFile(file.Name()); err != nil {
+			return err
+		}
+	}
+
+	// ioutil.TempFile creates files that are only readable by the owner
+	if err := os.Chmod(file.Name(), 0644); err != nil {
+		return err
+	}
+	if err := config.Preserve.restore(file.Name(), fileStat.Metadata); err != nil {
+		return err
+	}
+
+	// set the modified time to the s3 objects last modified time, so that the next sync doesn't download it again
+	if err := os.Chtimes(file.Name(), fileStat.ModTime, fileStat.ModTime); err != nil {
+		return err
+	}
+	if err := os.Rename(file.Name(), target); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// localTarget returns the path where an object with the name should be stored under basePath, it will return an
+// error if the name tries to escape the basePath, e.g. an object key like 'prefix/../../etc/passwd'
+func localTarget(basePath, name string) (string, error) {
+	target := filepath.Join(basePath, filepath.FromSlash(name))
+	if target != basePath && !strings.HasPrefix(target, basePath+string(filepath.Separator)) {
+		return "", fmt.Errorf("refusing to download '%s' to a path outside of %s", name, basePath)
+	}
+	return target, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// getMock returns the content of objects from a map of keys, the whole object in one response
+type getMock struct {
+	s3iface.S3API
+	objects map[string][]byte
+	heads   map[string]*s3.HeadObjectOutput
+}
+
+func (m *getMock) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	if head, ok := m.heads[*input.Key]; ok {
+		return head, nil
+	}
+	return &s3.HeadObjectOutput{}, nil
+}
+
+func (m *getMock) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	content := m.objects[*input.Key]
+	return &s3.GetObjectOutput{
+		Body:          ioutil.NopCloser(bytes.NewReader(content)),
+		ContentLength: aws.Int64(int64(len(content))),
+	}, nil
+}
+
+func TestLocalTarget(t *testing.T) {
+	base := filepath.FromSlash("/var/www")
+	tests := []struct {
+		name     string
+		expected string
+		err      bool
+	}{
+		{name: "file.html", expected: filepath.FromSlash("/var/www/file.html")},
+		{name: "dir/file.html", expected: filepath.FromSlash("/var/www/dir/file.html")},
+		{name: "dir/../file.html", expected: filepath.FromSlash("/var/www/file.html")},
+		{name: "../file.html", err: true},
+		{name: "dir/../../etc/passwd", err: true},
+		{name: "../www2/file.html", err: true},
+	}
+
+	for _, test := range tests {
+		actual, err := localTarget(base, test.name)
+		if test.err {
+			if err == nil {
+				t.Errorf("localTarget(%q) expected an error, got %s", test.name, actual)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("localTarget(%q) returned unexpected error %v", test.name, err)
+			continue
+		}
+		if actual != test.expected {
+			t.Errorf("localTarget(%q) => %s, want %s", test.name, actual, test.expected)
+		}
+	}
+}
+
+func TestDownloadDecompressesWithoutRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3sync-download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	logger, _ := getTestLogger()
+	content := []byte("body { color: red; }")
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	_, _ = w.Write(content)
+	_ = w.Close()
+	head := &s3.HeadObjectOutput{
+		ContentEncoding: aws.String(compressGzip),
+		Metadata:        map[string]*string{"Uncompressed-Size": aws.String(strconv.Itoa(len(content)))},
+	}
+	// no -compress rules, the object decides
+	config := &Config{
+		Mode:      Download,
+		Bucket:    "bucket",
+		LocalPath: dir,
+		S3Service: &getMock{
+			objects: map[string][]byte{"www/site.css": compressed.Bytes()},
+			heads:   map[string]*s3.HeadObjectOutput{"www/site.css": head},
+		},
+	}
+	modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	remote := &FileStat{Name: "site.css", Path: "www/site.css", Size: int64(compressed.Len()), ModTime: modTime, ETag: "abc"}
+	if err := download(config, remote, logger); err != nil {
+		t.Fatal(err)
+	}
+	downloaded, err := ioutil.ReadFile(filepath.Join(dir, "site.css"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(downloaded, content) {
+		t.Errorf("expected the object to be decompressed, got %q", downloaded)
+	}
+
+	// the next run compares the local file with the original size in the metadata and doesn't download it again
+	sources := make(chan *FileStat, 1)
+	sources <- &FileStat{Name: "site.css", Path: "www/site.css", Size: int64(compressed.Len()), ModTime: modTime, ETag: "abc"}
+	close(sources)
+	dests := make(chan *FileStat, 1)
+	dests <- &FileStat{Name: "site.css", Path: filepath.Join(dir, "site.css"), Size: int64(len(content)), ModTime: modTime}
+	close(dests)
+	files, _ := compare(config, sources, dests, logger)
+	for file := range files {
+		t.Errorf("expected the decompressed file to not be downloaded again, got %s", file.Name)
+	}
+}
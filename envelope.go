@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+)
+
+// Metadata that is stored on objects encrypted by s3sync, the wrapped data key and nonce are needed to decrypt them
+// and the plaintext size and HMAC to compare them with the original file. The HMAC is keyed by the data key, a plain
+// md5 would let anyone who can read the metadata confirm a guess of the content.
+const (
+	metaEncryptionKey  = "s3sync-key"
+	metaEncryptionWrap = "s3sync-key-wrap"
+	metaEncryptionIV   = "s3sync-iv"
+	metaPlaintextSize  = "plaintext-size"
+	metaPlaintextHMAC  = "plaintext-hmac"
+)
+
+// encryptionChunkSize is the size of the plaintext in each encrypted chunk. Files are encrypted in chunks so they can
+// be streamed, AES-GCM can't authenticate anything until it has seen all of the data.
+const encryptionChunkSize = 64 * 1024
+
+// encryptionTagSize is the size of the authentication tag that AES-GCM adds to every chunk
+const encryptionTagSize = 16
+
+// dataKeySize is the size of the data keys that files are encrypted with, they are 256 bit AES keys
+const dataKeySize = 32
+
+// KeyWrapper creates the data keys that files are encrypted with, and wraps them with a master key so that they can be
+// stored with the encrypted object
+type KeyWrapper interface {
+	// Name identifies how the keys are wrapped, it's stored with the object
+	Name() string
+	// GenerateKey returns a new data key and the data key wrapped by the master key
+	GenerateKey() (key, wrapped []byte, err error)
+	// UnwrapKey returns the data key from a wrapped key
+	UnwrapKey(wrapped []byte) ([]byte, error)
+}
+
+// localKeyWrapper wraps data keys with AES-GCM and a master key that is kept outside of aws
+type localKeyWrapper struct {
+	master cipher.AEAD
+}
+
+// newLocalKeyWrapper returns a KeyWrapper for a 256 bit master key
+func newLocalKeyWrapper(masterKey []byte) (KeyWrapper, error) {
+	aead, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return &localKeyWrapper{master: aead}, nil
+}
+
+func (w *localKeyWrapper) Name() string {
+	return "local"
+}
+
+// GenerateKey returns a random data key, the wrapped key is the random nonce followed by the sealed key
+func (w *localKeyWrapper) GenerateKey() ([]byte, []byte, error) {
+	key := make([]byte, dataKeySize)
+	nonce := make([]byte, w.master.NonceSize())
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return key, w.master.Seal(nonce, nonce, key, nil), nil
+}
+
+func (w *localKeyWrapper) UnwrapKey(wrapped []byte) ([]byte, error) {
+	if len(wrapped) < w.master.NonceSize() {
+		return nil, errors.New("the wrapped key is too short")
+	}
+	nonce, sealed := wrapped[:w.master.NonceSize()], wrapped[w.master.NonceSize():]
+	key, err := w.master.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, errors.New("could not unwrap the data key, the object was encrypted with another master key")
+	}
+	return key, nil
+}
+
+// kmsKeyWrapper gets data keys from KMS, the wrapped key is the encrypted data key that KMS can decrypt
+type kmsKeyWrapper struct {
+	kms   kmsiface.KMSAPI
+	keyID string
+}
+
+func (w *kmsKeyWrapper) Name() string {
+	return "kms"
+}
+
+func (w *kmsKeyWrapper) GenerateKey() ([]byte, []byte, error) {
+	resp, err := w.kms.GenerateDataKey(&kms.GenerateDataKeyInput{
+		KeyId:   aws.String(w.keyID),
+		KeySpec: aws.String(kms.DataKeySpecAes256),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp.Plaintext, resp.CiphertextBlob, nil
+}
+
+func (w *kmsKeyWrapper) UnwrapKey(wrapped []byte) ([]byte, error) {
+	resp, err := w.kms.Decrypt(&kms.DecryptInput{CiphertextBlob: wrapped})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Plaintext, nil
+}
+
+// newGCM returns AES-GCM for a 256 bit key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != dataKeySize {
+		return nil, fmt.Errorf("the key must be %d bytes", dataKeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// macKey returns the key of the plaintext HMAC, derived from the data key so the data key is only used for AES-GCM
+func macKey(dataKey []byte) []byte {
+	mac := hmac.New(sha256.New, dataKey)
+	_, _ = mac.Write([]byte("s3sync plaintext hmac"))
+	return mac.Sum(nil)
+}
+
+// chunkNonce returns the nonce of a chunk, the big endian chunk number xor'ed into the end of the random nonce of the
+// object. The chunks can't be reordered as each chunk has its own nonce.
+func chunkNonce(iv []byte, chunk uint64) []byte {
+	nonce := make([]byte, len(iv))
+	copy(nonce, iv)
+	counter := nonce[len(nonce)-8:]
+	binary.BigEndian.PutUint64(counter, binary.BigEndian.Uint64(counter)^chunk)
+	return nonce
+}
+
+// chunkData is the additional data of a chunk, it marks the last chunk so that a truncated object can't be decrypted
+func chunkData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// encryptFile encrypts the content of in into a temporary file with a new data key from keys, and returns it together
+// with the metadata that's needed to decrypt it. The caller must close and remove the temporary file.
+func encryptFile(in io.Reader, keys KeyWrapper) (*os.File, map[string]*string, error) {
+	key, wrapped, err := keys.GenerateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	iv := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return nil, nil, err
+	}
+
+	out, err := ioutil.TempFile("", "s3sync-encrypt-")
+	if err != nil {
+		return nil, nil, err
+	}
+	fail := func(err error) (*os.File, map[string]*string, error) {
+		_ = out.Close()
+		_ = os.Remove(out.Name())
+		return nil, nil, err
+	}
+
+	hash := hmac.New(sha256.New, macKey(key))
+	r := bufio.NewReaderSize(io.TeeReader(in, hash), encryptionChunkSize)
+	w := bufio.NewWriter(out)
+	plain := make([]byte, encryptionChunkSize)
+	sealed := make([]byte, 0, encryptionChunkSize+aead.Overhead())
+	var size int64
+	for chunk := uint64(0); ; chunk++ {
+		n, err := io.ReadFull(r, plain)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return fail(err)
+		}
+		size += int64(n)
+		// the chunk is the last one if the file ends here, an empty file is one empty chunk
+		_, peekErr := r.Peek(1)
+		last := err != nil || peekErr == io.EOF
+		sealed = aead.Seal(sealed[:0], chunkNonce(iv, chunk), plain[:n], chunkData(last))
+		if _, err := w.Write(sealed); err != nil {
+			return fail(err)
+		}
+		if last {
+			break
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fail(err)
+	}
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		return fail(err)
+	}
+	return out, map[string]*string{
+		metaEncryptionKey:  aws.String(base64.StdEncoding.EncodeToString(wrapped)),
+		metaEncryptionWrap: aws.String(keys.Name()),
+		metaEncryptionIV:   aws.String(base64.StdEncoding.EncodeToString(iv)),
+		metaPlaintextSize:  aws.String(strconv.FormatInt(size, 10)),
+		metaPlaintextHMAC:  aws.String(hex.EncodeToString(hash.Sum(nil))),
+	}, nil
+}
+
+// decryptFile replaces the encrypted content of the file at path with the plaintext, the metadata are the lower case
+// keys of the object metadata
+func decryptFile(path string, metadata map[string]string, keys KeyWrapper) error {
+	key, err := unwrapDataKey(metadata, keys)
+	if err != nil {
+		return err
+	}
+	iv, err := base64.StdEncoding.DecodeString(metadata[metaEncryptionIV])
+	if err != nil {
+		return fmt.Errorf("invalid iv: %v", err)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	if len(iv) != aead.NonceSize() {
+		return errors.New("invalid iv")
+	}
+
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+	out, err := os.Create(path + ".decrypt")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// after a successful rename this will fail silently as the file is gone
+		_ = os.Remove(out.Name())
+	}()
+
+	r := bufio.NewReaderSize(in, encryptionChunkSize+aead.Overhead())
+	w := bufio.NewWriter(out)
+	sealed := make([]byte, encryptionChunkSize+aead.Overhead())
+	plain := make([]byte, 0, encryptionChunkSize)
+	for chunk := uint64(0); ; chunk++ {
+		n, err := io.ReadFull(r, sealed)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			_ = out.Close()
+			return err
+		}
+		_, peekErr := r.Peek(1)
+		last := err != nil || peekErr == io.EOF
+		plain, err = aead.Open(plain[:0], chunkNonce(iv, chunk), sealed[:n], chunkData(last))
+		if err != nil {
+			_ = out.Close()
+			return fmt.Errorf("could not decrypt chunk %d, the object has been modified or truncated", chunk)
+		}
+		if _, err := w.Write(plain); err != nil {
+			_ = out.Close()
+			return err
+		}
+		if last {
+			break
+		}
+	}
+	if err := w.Flush(); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), path)
+}
+
+// unwrapDataKey returns the data key of an object encrypted by s3sync, the metadata are the lower case keys of the
+// object metadata
+func unwrapDataKey(metadata map[string]string, keys KeyWrapper) ([]byte, error) {
+	if keys == nil {
+		return nil, errors.New("the object is encrypted by s3sync, use -client-encryption-key or -client-encryption-kms-key-id to decrypt it")
+	}
+	if wrap := metadata[metaEncryptionWrap]; wrap != keys.Name() {
+		return nil, fmt.Errorf("the object is encrypted with a %s key, not a %s key", wrap, keys.Name())
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(metadata[metaEncryptionKey])
+	if err != nil {
+		return nil, fmt.Errorf("invalid wrapped key: %v", err)
+	}
+	return keys.UnwrapKey(wrapped)
+}
+
+// sameContent returns true if the file at path has the content that the object encrypted by s3sync was encrypted from
+func sameContent(path string, metadata map[string]string, keys KeyWrapper) (bool, error) {
+	expected, err := hex.DecodeString(metadata[metaPlaintextHMAC])
+	if err != nil || len(expected) == 0 {
+		return false, errors.New("the object has no plaintext hmac")
+	}
+	key, err := unwrapDataKey(metadata, keys)
+	if err != nil {
+		return false, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	hash := hmac.New(sha256.New, macKey(key))
+	if _, err := io.Copy(hash, file); err != nil {
+		return false, err
+	}
+	return hmac.Equal(hash.Sum(nil), expected), nil
+}
+
+// plaintextSize returns the size of the file that an object of the size was encrypted from, if it was encrypted by
+// s3sync. Every chunk adds a tag and only the last chunk can be short, so ok is false for sizes that no file encrypts
+// to.
+func plaintextSize(size int64) (int64, bool) {
+	chunk := int64(encryptionChunkSize + encryptionTagSize)
+	full, rest := size/chunk, size%chunk
+	switch {
+	case rest == 0 && full > 0:
+		return size - full*encryptionTagSize, true
+	case rest > encryptionTagSize || rest == encryptionTagSize && full == 0:
+		return size - (full+1)*encryptionTagSize, true
+	}
+	return 0, false
+}
+
+// withPlaintextSize returns source and dest with the object replaced by a copy that has the size of the plaintext, if
+// the object hasn't been fetched with HeadObject and can have been encrypted by s3sync. That way encrypted objects can
+// be compared with the local files without fetching the metadata of every object. ok is false if the size shows
+// that the object wasn't encrypted by s3sync.
+func withPlaintextSize(source, dest *FileStat) (*FileStat, *FileStat, bool) {
+	remote := remoteFile(source, dest)
+	if remote == nil || remote.Metadata != nil {
+		return source, dest, true
+	}
+	size, ok := plaintextSize(remote.Size)
+	if !ok {
+		return source, dest, false
+	}
+	plain := *remote
+	plain.Size = size
+	if remote == source {
+		return &plain, dest, true
+	}
+	return source, &plain, true
+}
+
+// needsEncryptionMetadata returns true if the object hasn't been fetched with HeadObject and has the size that the
+// local file would have when encrypted, so only the metadata can tell if the content is the same
+func needsEncryptionMetadata(config *Config, source, dest *FileStat) bool {
+	remote := remoteFile(source, dest)
+	if config.ClientEncryption == nil || remote == nil || remote.Metadata != nil {
+		return false
+	}
+	local := source
+	if remote == source {
+		local = dest
+	}
+	size, ok := plaintextSize(remote.Size)
+	return ok && size == local.Size
+}
+
+// encryptedBySync returns true if the remote file was encrypted by s3sync, and should be decrypted when it's downloaded
+func encryptedBySync(file *FileStat) bool {
+	_, ok := file.Metadata[metaEncryptionKey]
+	return ok
+}
+
+// applyEncryptionMetadata changes the Size of a remote file that was encrypted by s3sync to the size of the plaintext,
+// so that it can be compared to the local file. The content is compared with sameContent.
+func applyEncryptionMetadata(file *FileStat) {
+	if !encryptedBySync(file) {
+		return
+	}
+	if size, err := strconv.ParseInt(file.Metadata[metaPlaintextSize], 10, 64); err == nil {
+		file.Size = size
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+)
+
+// kmsMock "wraps" data keys by reversing them, which is enough to test that the wrapped key is what's stored
+type kmsMock struct {
+	kmsiface.KMSAPI
+}
+
+func (m *kmsMock) GenerateDataKey(input *kms.GenerateDataKeyInput) (*kms.GenerateDataKeyOutput, error) {
+	key := bytes.Repeat([]byte{7}, dataKeySize)
+	key[0] = 1
+	return &kms.GenerateDataKeyOutput{Plaintext: key, CiphertextBlob: reverse(key), KeyId: input.KeyId}, nil
+}
+
+func (m *kmsMock) Decrypt(input *kms.DecryptInput) (*kms.DecryptOutput, error) {
+	return &kms.DecryptOutput{Plaintext: reverse(input.CiphertextBlob)}, nil
+}
+
+func reverse(data []byte) []byte {
+	reversed := make([]byte, len(data))
+	for i, b := range data {
+		reversed[len(data)-1-i] = b
+	}
+	return reversed
+}
+
+// encryptTestFile encrypts content with keys and returns the encrypted bytes and the metadata as HeadObject returns it
+func encryptTestFile(t *testing.T, content []byte, keys KeyWrapper) ([]byte, map[string]string) {
+	encrypted, metadata, err := encryptFile(bytes.NewReader(content), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = encrypted.Close()
+		_ = os.Remove(encrypted.Name())
+	}()
+	data, err := ioutil.ReadAll(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := make(map[string]string, len(metadata))
+	for key, value := range metadata {
+		meta[key] = aws.StringValue(value)
+	}
+	return data, meta
+}
+
+// decryptTestFile writes data to a file in dir and decrypts it
+func decryptTestFile(dir string, data []byte, metadata map[string]string, keys KeyWrapper) ([]byte, error) {
+	path := filepath.Join(dir, "object")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return nil, err
+	}
+	if err := decryptFile(path, metadata, keys); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(path)
+}
+
+func TestEncryptFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3sync-envelope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	local, err := newLocalKeyWrapper(bytes.Repeat([]byte{42}, dataKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, keys := range []KeyWrapper{local, &kmsKeyWrapper{kms: &kmsMock{}, keyID: "alias/exports"}} {
+		for _, size := range []int{0, 1, encryptionChunkSize, encryptionChunkSize + 1, 3 * encryptionChunkSize} {
+			content := bytes.Repeat([]byte("export;"), size/7+1)[:size]
+			data, metadata := encryptTestFile(t, content, keys)
+			if bytes.Contains(data, []byte("export;")) {
+				t.Errorf("%s: the plaintext of %d bytes is in the encrypted file", keys.Name(), size)
+			}
+			sum := md5.Sum(content)
+			if metadata[metaPlaintextSize] != strconv.Itoa(size) || len(metadata[metaPlaintextHMAC]) != 64 || strings.Contains(metadata[metaPlaintextHMAC], hex.EncodeToString(sum[:])) {
+				t.Errorf("%s: unexpected plaintext metadata for %d bytes: %v", keys.Name(), size, metadata)
+			}
+			decrypted, err := decryptTestFile(dir, data, metadata, keys)
+			if err != nil {
+				t.Errorf("%s: could not decrypt %d bytes: %v", keys.Name(), size, err)
+			} else if !bytes.Equal(decrypted, content) {
+				t.Errorf("%s: decrypting %d bytes gave %d other bytes", keys.Name(), size, len(decrypted))
+			}
+		}
+	}
+}
+
+func TestPlaintextSize(t *testing.T) {
+	keys, _ := newLocalKeyWrapper(bytes.Repeat([]byte{42}, dataKeySize))
+	for _, size := range []int{0, 1, encryptionChunkSize - 1, encryptionChunkSize, encryptionChunkSize + 1, 3 * encryptionChunkSize} {
+		data, _ := encryptTestFile(t, make([]byte, size), keys)
+		if plain, ok := plaintextSize(int64(len(data))); !ok || plain != int64(size) {
+			t.Errorf("expected %d bytes encrypted to %d bytes to have a plaintext size, got %d and %v", size, len(data), plain, ok)
+		}
+	}
+	for _, size := range []int64{0, 15, encryptionChunkSize + encryptionTagSize + 16} {
+		if plain, ok := plaintextSize(size); ok {
+			t.Errorf("expected no file to encrypt to %d bytes, got %d", size, plain)
+		}
+	}
+}
+
+func TestDecryptFileRejectsModifiedObjects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3sync-envelope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	keys, _ := newLocalKeyWrapper(bytes.Repeat([]byte{42}, dataKeySize))
+	otherKeys, _ := newLocalKeyWrapper(bytes.Repeat([]byte{43}, dataKeySize))
+	content := bytes.Repeat([]byte{1}, 2*encryptionChunkSize+10)
+	data, metadata := encryptTestFile(t, content, keys)
+
+	modified := append([]byte{}, data...)
+	modified[100] ^= 1
+	chunk := encryptionChunkSize + 16
+	tests := map[string]struct {
+		data     []byte
+		metadata map[string]string
+		keys     KeyWrapper
+	}{
+		"modified":       {data: modified, metadata: metadata, keys: keys},
+		"truncated":      {data: data[:2*chunk], metadata: metadata, keys: keys},
+		"reordered":      {data: append(append(append([]byte{}, data[chunk:2*chunk]...), data[:chunk]...), data[2*chunk:]...), metadata: metadata, keys: keys},
+		"other key":      {data: data, metadata: metadata, keys: otherKeys},
+		"other wrapping": {data: data, metadata: metadata, keys: &kmsKeyWrapper{kms: &kmsMock{}}},
+		"no key":         {data: data, metadata: metadata},
+	}
+	for name, test := range tests {
+		if _, err := decryptTestFile(dir, test.data, test.metadata, test.keys); err == nil {
+			t.Errorf("%s: expected decryption to fail", name)
+		}
+	}
+}
+
+func TestSameContent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3sync-envelope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	keys, _ := newLocalKeyWrapper(bytes.Repeat([]byte{42}, dataKeySize))
+	content := []byte("id;name\n1;export\n")
+	_, metadata := encryptTestFile(t, content, keys)
+	_, again := encryptTestFile(t, content, keys)
+	if metadata[metaPlaintextHMAC] == again[metaPlaintextHMAC] {
+		t.Error("expected the same content encrypted twice to get different HMACs")
+	}
+
+	path := filepath.Join(dir, "export.csv")
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if same, err := sameContent(path, metadata, keys); !same || err != nil {
+		t.Errorf("expected the same content, got %v and %v", same, err)
+	}
+	if err := ioutil.WriteFile(path, []byte("id;name\n1;exporT\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if same, err := sameContent(path, metadata, keys); same || err != nil {
+		t.Errorf("expected other content, got %v and %v", same, err)
+	}
+	otherKeys, _ := newLocalKeyWrapper(bytes.Repeat([]byte{43}, dataKeySize))
+	if _, err := sameContent(path, metadata, otherKeys); err == nil {
+		t.Error("expected an error with another master key")
+	}
+}
+
+func TestApplyEncryptionMetadata(t *testing.T) {
+	file := &FileStat{Size: 1056, ETag: "ciphertext", Metadata: map[string]string{
+		metaEncryptionKey: "key", metaPlaintextSize: "1040", metaPlaintextHMAC: "plaintext",
+	}}
+	applyEncryptionMetadata(file)
+	if file.Size != 1040 || file.ETag != "ciphertext" {
+		t.Errorf("expected the plaintext size and the ETag of the object, got %d and %s", file.Size, file.ETag)
+	}
+
+	plain := &FileStat{Size: 10, ETag: "abc", Metadata: map[string]string{}}
+	applyEncryptionMetadata(plain)
+	if plain.Size != 10 || plain.ETag != "abc" || encryptedBySync(plain) {
+		t.Errorf("expected an object that isn't encrypted to be unchanged, got %+v", plain)
+	}
+}
+
+func TestShouldSyncUnencryptedObjects(t *testing.T) {
+	keys, _ := newLocalKeyWrapper(bytes.Repeat([]byte{42}, dataKeySize))
+	config := &Config{Mode: Upload, ClientEncryption: keys}
+	local := &FileStat{Name: "export.csv", Size: 10}
+
+	if sync, reason := shouldSync(config, sizeOnlyStrategy{}, local, &FileStat{Name: "export.csv", Size: 10, Metadata: map[string]string{}}); !sync {
+		t.Errorf("expected an object that isn't encrypted to be uploaded again, got %s", reason)
+	}
+	encrypted := &FileStat{Name: "export.csv", Size: 10, Metadata: map[string]string{metaEncryptionKey: "key"}}
+	if sync, reason := shouldSync(config, sizeOnlyStrategy{}, local, encrypted); sync {
+		t.Errorf("expected an unchanged encrypted object to be skipped, got %s", reason)
+	}
+
+	// objects that haven't been fetched with HeadObject are compared by the size of the plaintext
+	listed := &FileStat{Name: "export.csv", Size: 10 + encryptionTagSize, ETag: "ciphertext"}
+	if sync, reason := shouldSync(config, sizeOnlyStrategy{}, local, listed); sync || listed.Size != 10+encryptionTagSize {
+		t.Errorf("expected an object with the encrypted size to be skipped and left as it was, got %s and %d", reason, listed.Size)
+	}
+	if !needsEncryptionMetadata(config, local, listed) {
+		t.Error("expected an object with the encrypted size to need its metadata when the strategy wants to sync it")
+	}
+	if sync, reason := shouldSync(config, sizeOnlyStrategy{}, local, &FileStat{Name: "export.csv", Size: 10, ETag: "plaintext"}); !sync || reason != "object isn't encrypted" {
+		t.Errorf("expected an object with a size that no file encrypts to to be uploaded again, got %s", reason)
+	}
+	download := &Config{Mode: Download, ClientEncryption: keys}
+	if sync, reason := shouldSync(download, sizeOnlyStrategy{}, listed, local); sync {
+		t.Errorf("expected an unchanged encrypted object to not be downloaded, got %s", reason)
+	}
+}
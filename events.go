@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Event types
+const (
+	EventUpload   = "upload"
+	EventDownload = "download"
+	EventCopy     = "copy"
+	EventDelete   = "delete"
+	EventSkip     = "skip"
+	EventError    = "error"
+	EventSummary  = "summary"
+	EventProgress = "progress"
+	EventLog      = "log"
+)
+
+// Event is something that happened during a sync, it's printed as text or sent as JSON to an EventSink
+type Event struct {
+	Type   string `json:"type"`
+	DryRun bool   `json:"dryrun,omitempty"`
+	// Name is the path of the file relative to the source and destination
+	Name string `json:"name,omitempty"`
+	// Key is the s3 uri of the object, when downloading it's the source object and otherwise the destination object
+	Key string `json:"key,omitempty"`
+	// Source is the s3 uri of the source object when copying between buckets
+	Source    string  `json:"source,omitempty"`
+	LocalPath string  `json:"local_path,omitempty"`
+	Size      int64   `json:"size,omitempty"`
+	Duration  float64 `json:"duration,omitempty"`
+	Reason    string  `json:"reason,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	Attempts  int     `json:"attempts,omitempty"`
+	// Headers are the headers that rules set on an uploaded or copied object
+	Headers map[string]string `json:"headers,omitempty"`
+	// Tags are the tags that rules set on an uploaded object
+	Tags map[string]string `json:"tags,omitempty"`
+	// Level and Message are set for log lines, i.e. everything that is written to Logger.Out, Logger.Err and Logger.Debug
+	Level   string         `json:"level,omitempty"`
+	Message string         `json:"message,omitempty"`
+	Summary *SummaryCounts `json:"summary,omitempty"`
+}
+
+// EventSink receives all events when the output isn't plain text
+type EventSink interface {
+	Emit(e *Event)
+}
+
+// jsonSink writes events as JSON Lines, one JSON object per line
+type jsonSink struct {
+	mu             sync.Mutex
+	enc            *json.Encoder
+	onlyShowErrors bool
+}
+
+func newJSONSink(w io.Writer, onlyShowErrors bool) *jsonSink {
+	return &jsonSink{enc: json.NewEncoder(w), onlyShowErrors: onlyShowErrors}
+}
+
+// Emit writes the event, it's safe for concurrent use
+func (s *jsonSink) Emit(e *Event) {
+	if s.onlyShowErrors && e.Type != EventError && e.Level != "error" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_ = s.enc.Encode(e)
+}
+
+// sinkWriter turns every line written by a log.Logger into a log event
+type sinkWriter struct {
+	sink  EventSink
+	level string
+}
+
+func (w *sinkWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	if msg != "" {
+		w.sink.Emit(&Event{Type: EventLog, Level: w.level, Message: msg})
+	}
+	return len(p), nil
+}
+
+// Event sends the event to the Events sink, or prints it as text if there is no sink
+func (l *Logger) Event(e *Event) {
+	if l.Events != nil {
+		l.Events.Emit(e)
+		return
+	}
+
+	prefix := ""
+	if e.DryRun {
+		prefix = "(dryrun) "
+	}
+	switch e.Type {
+	case EventUpload:
+		// the headers are only shown in dry runs, to check the rules before running the sync for real
+		if e.DryRun && len(e.Headers) > 0 {
+			l.Out.Printf("%supload: %s to %s (%s)\n", prefix, e.Name, e.Key, formatHeaders(e.Headers))
+		} else {
+			l.Out.Printf("%supload: %s to %s\n", prefix, e.Name, e.Key)
+		}
+	case EventDownload:
+		l.Out.Printf("%sdownload: %s to %s\n", prefix, e.Key, e.LocalPath)
+	case EventCopy:
+		if e.DryRun && len(e.Headers) > 0 {
+			l.Out.Printf("%scopy: %s to %s (%s)\n", prefix, e.Source, e.Key, formatHeaders(e.Headers))
+		} else {
+			l.Out.Printf("%scopy: %s to %s\n", prefix, e.Source, e.Key)
+		}
+	case EventDelete:
+		target := e.Key
+		if target == "" {
+			target = e.LocalPath
+		}
+		l.Out.Printf("%sdelete: %s\n", prefix, target)
+	case EventSkip:
+		l.Debug.Printf("skipping: %s, %s\n", e.Name, e.Reason)
+	case EventError:
+		if e.Attempts > 1 {
+			l.Err.Printf("%s (after %d attempts)\n", e.Error, e.Attempts)
+		} else {
+			l.Err.Println(e.Error)
+		}
+	case EventSummary:
+		l.Out.Printf("%sSummary: %s\n", prefix, e.Message)
+	default:
+		l.Out.Println(e.Message)
+	}
+}
+
+// fileEvent returns an event for the file with the name, s3 uris and local path filled in for the config.Mode
+func fileEvent(config *Config, file *FileStat) *Event {
+	e := &Event{
+		Type:   config.Mode.String(),
+		DryRun: config.DryRun,
+		Name:   file.Name,
+		Size:   file.Size,
+	}
+	switch config.Mode {
+	case Download:
+		e.Key = "s3://" + path.Join(config.Bucket, file.Path)
+		e.LocalPath, _ = localTarget(config.LocalPath, file.Name)
+	case Copy:
+		e.Source = "s3://" + path.Join(config.Source.Bucket, file.Path)
+		e.Key = "s3://" + path.Join(config.Bucket, objectKey(config.BucketPrefix, file.Name))
+		e.Headers = config.Rules.match(file.Name).copyProperties().headers()
+	default:
+		e.LocalPath = file.Path
+		e.Key = "s3://" + path.Join(config.Bucket, objectKey(config.BucketPrefix, file.Name))
+		props := config.Rules.match(file.Name)
+		e.Headers = props.headers()
+		e.Tags = props.Tags
+	}
+	return e
+}
+
+// resultEvent returns the event for the result of a file transfer
+func resultEvent(config *Config, result *Result) *Event {
+	e := fileEvent(config, result.File)
+	e.Duration = result.Duration.Seconds()
+	e.Attempts = result.Attempts
+	if result.Err != nil {
+		e.Type = EventError
+		e.Error = result.Err.Error()
+	}
+	return e
+}
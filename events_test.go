@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventText(t *testing.T) {
+	tests := []struct {
+		event    *Event
+		expected string
+	}{
+		{
+			event:    &Event{Type: EventUpload, Name: "file.html", Key: "s3://bucket/www/file.html"},
+			expected: "[Out] upload: file.html to s3://bucket/www/file.html\n",
+		},
+		{
+			event:    &Event{Type: EventUpload, DryRun: true, Name: "file.html", Key: "s3://bucket/www/file.html"},
+			expected: "[Out] (dryrun) upload: file.html to s3://bucket/www/file.html\n",
+		},
+		{
+			event:    &Event{Type: EventUpload, DryRun: true, Name: "file.html", Key: "s3://bucket/www/file.html", Headers: map[string]string{"Content-Type": "text/html", "Cache-Control": "no-cache"}},
+			expected: "[Out] (dryrun) upload: file.html to s3://bucket/www/file.html (Cache-Control: no-cache, Content-Type: text/html)\n",
+		},
+		{
+			event:    &Event{Type: EventUpload, Name: "file.html", Key: "s3://bucket/www/file.html", Headers: map[string]string{"Cache-Control": "no-cache"}},
+			expected: "[Out] upload: file.html to s3://bucket/www/file.html\n",
+		},
+		{
+			event:    &Event{Type: EventUpload, DryRun: true, Name: "file.html", Key: "s3://bucket/www/file.html", Headers: map[string]string{"x-amz-tagging": "env=prod&team=web"}, Tags: map[string]string{"env": "prod", "team": "web"}},
+			expected: "[Out] (dryrun) upload: file.html to s3://bucket/www/file.html (x-amz-tagging: env=prod&team=web)\n",
+		},
+		{
+			event:    &Event{Type: EventDownload, Key: "s3://bucket/www/file.html", LocalPath: "/var/www/file.html"},
+			expected: "[Out] download: s3://bucket/www/file.html to /var/www/file.html\n",
+		},
+		{
+			event:    &Event{Type: EventCopy, Source: "s3://a/file.html", Key: "s3://b/file.html"},
+			expected: "[Out] copy: s3://a/file.html to s3://b/file.html\n",
+		},
+		{
+			event:    &Event{Type: EventDelete, DryRun: true, Key: "s3://bucket/old.html"},
+			expected: "[Out] (dryrun) delete: s3://bucket/old.html\n",
+		},
+		{
+			event:    &Event{Type: EventDelete, LocalPath: "/var/www/old.html"},
+			expected: "[Out] delete: /var/www/old.html\n",
+		},
+		{
+			event:    &Event{Type: EventSkip, Name: "file.html", Reason: "same size"},
+			expected: "[DEBUG] skipping: file.html, same size\n",
+		},
+		{
+			event:    &Event{Type: EventError, Error: "access denied"},
+			expected: "[Err] access denied\n",
+		},
+	}
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		logger := &Logger{
+			Out:   log.New(buf, "[Out] ", 0),
+			Err:   log.New(buf, "[Err] ", 0),
+			Debug: log.New(buf, "[DEBUG] ", 0),
+		}
+		logger.Event(test.event)
+		if buf.String() != test.expected {
+			t.Errorf("Expected %q, got %q", test.expected, buf.String())
+		}
+	}
+}
+
+func TestEventJSON(t *testing.T) {
+	buf := new(bytes.Buffer)
+	sink := newJSONSink(buf, false)
+	logger := &Logger{
+		Out:    log.New(&sinkWriter{sink: sink, level: "info"}, "", 0),
+		Err:    log.New(&sinkWriter{sink: sink, level: "error"}, "", 0),
+		Debug:  log.New(&sinkWriter{sink: sink, level: "debug"}, "", 0),
+		Events: sink,
+	}
+
+	rules := &ObjectRules{}
+	rules.add(&ObjectRule{Pattern: "dir/**", Tags: map[string]string{"team": "web"}})
+	if err := rules.compile(globOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{Bucket: "bucket", BucketPrefix: "www", Rules: rules}
+	file := &FileStat{Name: "dir/file.html", Path: "/var/www/dir/file.html", Size: 12}
+	logger.Event(resultEvent(config, &Result{File: file, Duration: 1500 * time.Millisecond}))
+	logger.Event(resultEvent(config, &Result{File: file, Err: errors.New("access denied")}))
+	logger.Out.Printf("hello %s\n", "world")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 JSON lines, got %d: %s", len(lines), buf)
+	}
+
+	var events []Event
+	for _, line := range lines {
+		var e Event
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("Could not parse %q: %v", line, err)
+		}
+		events = append(events, e)
+	}
+
+	expected := Event{Type: EventUpload, Name: "dir/file.html", Key: "s3://bucket/www/dir/file.html", LocalPath: "/var/www/dir/file.html", Size: 12, Duration: 1.5,
+		Headers: map[string]string{"x-amz-tagging": "team=web"}, Tags: map[string]string{"team": "web"}}
+	if !reflect.DeepEqual(events[0], expected) {
+		t.Errorf("Expected %+v, got %+v", expected, events[0])
+	}
+	if events[1].Type != EventError || events[1].Error != "access denied" || events[1].Key != expected.Key {
+		t.Errorf("Expected an error event for %s, got %+v", expected.Key, events[1])
+	}
+	if events[2].Type != EventLog || events[2].Level != "info" || events[2].Message != "hello world" {
+		t.Errorf("Expected an info log event, got %+v", events[2])
+	}
+}
+
+func TestEventJSONOnlyShowErrors(t *testing.T) {
+	buf := new(bytes.Buffer)
+	sink := newJSONSink(buf, true)
+	sink.Emit(&Event{Type: EventUpload, Name: "file.html"})
+	sink.Emit(&Event{Type: EventError, Error: "access denied"})
+	sink.Emit(&Event{Type: EventLog, Level: "error", Message: "broken"})
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 2 {
+		t.Errorf("Expected only the 2 errors, got %d lines: %s", len(lines), buf)
+	}
+}
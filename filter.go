@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"path"
+)
+
+// filterRule is one -include or -exclude pattern
+type filterRule struct {
+	include bool
+	pattern string
+	glob    *glob
+}
+
+// Filter decides which files and objects are part of the sync from -include and -exclude patterns. The rules are
+// evaluated in the order they were given and the last rule that matches a file decides if it's included, files that
+// doesn't match any rule are included. A rule matches a file if the pattern matches the name of the file or any of the
+// directories it's in. Files that are ignored by ignore files are always excluded. The patterns must be compiled
+// before the filter is used. All methods are safe to call on a nil Filter, which includes everything.
+type Filter struct {
+	rules   []filterRule
+	ignores *ignoreFiles
+}
+
+// add appends a rule to the filter
+func (f *Filter) add(include bool, pattern string) {
+	f.rules = append(f.rules, filterRule{include: include, pattern: pattern})
+}
+
+// compile compiles the patterns of all rules with the options, it returns an error for the first malformed pattern
+func (f *Filter) compile(opts globOptions) error {
+	for i := range f.rules {
+		g, err := compileGlob(f.rules[i].pattern, opts)
+		if err != nil {
+			return err
+		}
+		f.rules[i].glob = g
+	}
+	return nil
+}
+
+// lastMatch returns the index of the last rule that matches the name or any of its directories, or -1
+func (f *Filter) lastMatch(name string) int {
+	if f == nil {
+		return -1
+	}
+	for i := len(f.rules) - 1; i >= 0; i-- {
+		for dir := name; dir != "" && dir != "."; dir = path.Dir(dir) {
+			if f.rules[i].glob.match(dir) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// excluded returns true if the file with the name, relative to the source or destination, isn't part of the sync
+func (f *Filter) excluded(name string) bool {
+	if f != nil && f.ignores.ignored(name, false) {
+		return true
+	}
+	i := f.lastMatch(name)
+	return i >= 0 && !f.rules[i].include
+}
+
+// skipDir returns true if nothing in the directory can be part of the sync, so there's no need to walk it. That's the
+// case when the directory is excluded and there are no include rules after the rule that excluded it, since that rule
+// matches everything in the directory. Directories that are ignored by ignore files are also skipped.
+func (f *Filter) skipDir(name string) bool {
+	if f != nil && f.ignores.ignored(name, true) {
+		return true
+	}
+	i := f.lastMatch(name)
+	if i < 0 || f.rules[i].include {
+		return false
+	}
+	for _, rule := range f.rules[i+1:] {
+		if rule.include {
+			return false
+		}
+	}
+	return true
+}
+
+// filterFlag adds -include or -exclude rules to a Filter, so that both flags adds to the same ordered list of rules
+type filterFlag struct {
+	filter  *Filter
+	include bool
+}
+
+// String is the method to format the flag's value, part of the flag.Value interface
+func (f *filterFlag) String() string {
+	if f.filter == nil {
+		return ""
+	}
+	var patterns []string
+	for _, rule := range f.filter.rules {
+		if rule.include == f.include {
+			patterns = append(patterns, rule.pattern)
+		}
+	}
+	return fmt.Sprint(patterns)
+}
+
+// Set is the method to set the flag value, part of the flag.Value interface
+func (f *filterFlag) Set(value string) error {
+	f.filter.add(f.include, value)
+	return nil
+}
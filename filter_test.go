@@ -0,0 +1,66 @@
+package main
+
+import "testing"
+
+func TestFilterExcluded(t *testing.T) {
+	tests := []struct {
+		filter   *Filter
+		name     string
+		expected bool
+	}{
+		{filter: nil, name: "file.html", expected: false},
+		{filter: testFilter(), name: "file.html", expected: false},
+		{filter: testFilter("-*.bak"), name: "file.html", expected: false},
+		{filter: testFilter("-*.bak"), name: "dir/file.bak", expected: true},
+		{filter: testFilter("-dir"), name: "dir/file.html", expected: true},
+		{filter: testFilter("-dir"), name: "other/dir.html", expected: false},
+		{filter: testFilter("-dir/sub"), name: "dir/sub/deep/file.html", expected: true},
+		{filter: testFilter("-*", "+*.css", "+*.js"), name: "assets/site.css", expected: false},
+		{filter: testFilter("-*", "+*.css", "+*.js"), name: "assets/site.js", expected: false},
+		{filter: testFilter("-*", "+*.css", "+*.js"), name: "index.html", expected: true},
+		{filter: testFilter("+*.css", "-*"), name: "site.css", expected: true},
+		{filter: testFilter("-*", "+*.css", "-vendor/*"), name: "vendor/lib.css", expected: true},
+		{filter: testFilter("-*", "+*.css", "-vendor/*"), name: "site.css", expected: false},
+	}
+	for _, test := range tests {
+		if actual := test.filter.excluded(test.name); actual != test.expected {
+			t.Errorf("%v excluded(%q) => %t, want %t", test.filter, test.name, actual, test.expected)
+		}
+	}
+}
+
+func TestFilterSkipDir(t *testing.T) {
+	tests := []struct {
+		filter   *Filter
+		name     string
+		expected bool
+	}{
+		{filter: nil, name: "dir", expected: false},
+		{filter: testFilter("-dir"), name: "dir", expected: true},
+		{filter: testFilter("-dir"), name: "dir/sub", expected: true},
+		{filter: testFilter("-dir", "+*.css"), name: "dir", expected: false},
+		{filter: testFilter("+*.css", "-dir"), name: "dir", expected: true},
+		{filter: testFilter("-dir", "+dir"), name: "dir", expected: false},
+		{filter: testFilter("-*.html"), name: "dir", expected: false},
+	}
+	for _, test := range tests {
+		if actual := test.filter.skipDir(test.name); actual != test.expected {
+			t.Errorf("%v skipDir(%q) => %t, want %t", test.filter, test.name, actual, test.expected)
+		}
+	}
+}
+
+func TestFilterFlag(t *testing.T) {
+	filter := &Filter{}
+	exclude := &filterFlag{filter: filter}
+	include := &filterFlag{filter: filter, include: true}
+	_ = exclude.Set("*")
+	_ = include.Set("*.css")
+	_ = exclude.Set("vendor")
+	if len(filter.rules) != 3 || filter.rules[0].include || !filter.rules[1].include || filter.rules[2].include {
+		t.Errorf("expected the rules in the order the flags were given, got %+v", filter.rules)
+	}
+	if exclude.String() != "[* vendor]" || include.String() != "[*.css]" {
+		t.Errorf("unexpected flag values %s and %s", exclude, include)
+	}
+}
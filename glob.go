@@ -1,54 +1,203 @@
 package main
 
-import "strings"
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"unicode"
+)
 
-// GLOB is the string we use for detecting globbing
-const GLOB = "*"
+// globOptions changes how glob patterns are matched
+type globOptions struct {
+	// Slash stops '*', '?' and character classes from matching '/', so that only '**' matches across directories.
+	// Without it '*' matches any characters including '/', which is how patterns always have worked in s3sync.
+	Slash bool
+	// Basename matches patterns that doesn't contain a '/' against the last element of the path only, so they match
+	// files and directories at any depth. Patterns that starts with a '/' are always anchored to the root.
+	Basename bool
+}
 
-func globMatch(pattern, subj string) bool {
+// glob is a compiled glob pattern. '*' matches any characters and '?' any single character, but not '/' with
+// globOptions.Slash. '**' matches any characters including '/', and "**/" also matches no directory at all. '[abc]'
+// matches one of the characters, with ranges like '[a-z]' and negation like '[!a-z]' or '[^a-z]'. '{a,b}' matches one
+// of the comma separated alternatives, which can be patterns themselves. A '\' escapes the next character, e.g. '\*'
+// only matches a '*'.
+//
+// Patterns are matched against the whole path relative to the root of the sync, a leading '/' is allowed to make it
+// clear that the pattern is anchored to the root.
+type glob struct {
+	pattern  string
+	basename bool
+	re       *regexp.Regexp
+}
+
+// compileGlob compiles the pattern, it returns an error if the pattern is malformed, like an unclosed '[' or '{'
+func compileGlob(pattern string, opts globOptions) (*glob, error) {
+	g := &glob{pattern: pattern}
+	anchored := strings.HasPrefix(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+	g.basename = opts.Basename && !anchored && !strings.Contains(pattern, "/")
 
-	// Empty pattern can only match empty subject
-	if pattern == "" {
-		return subj == pattern
+	p := &globParser{pattern: []rune(pattern), slash: opts.Slash}
+	expr, err := p.parse(false)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern '%s': %v", g.pattern, err)
 	}
+	if g.re, err = regexp.Compile(`(?s)^` + expr + `$`); err != nil {
+		return nil, fmt.Errorf("invalid pattern '%s': %v", g.pattern, err)
+	}
+	return g, nil
+}
 
-	// If the pattern _is_ a glob, it matches everything
-	if pattern == GLOB {
-		return true
+// match returns true if the name, a '/' separated path relative to the root, matches the pattern
+func (g *glob) match(name string) bool {
+	if g.basename {
+		name = path.Base(name)
 	}
+	return g.re.MatchString(name)
+}
 
-	parts := strings.Split(pattern, GLOB)
+func (g *glob) String() string {
+	return g.pattern
+}
 
-	if len(parts) == 1 {
-		// No globs in pattern, so test for equality
-		return subj == pattern
+// globMatch returns true if the subject matches the pattern with the default options. Malformed patterns only matches
+// a subject that is exactly the same as the pattern.
+func globMatch(pattern, subj string) bool {
+	g, err := compileGlob(pattern, globOptions{})
+	if err != nil {
+		return pattern == subj
 	}
+	return g.match(subj)
+}
 
-	leadingGlob := strings.HasPrefix(pattern, GLOB)
-	trailingGlob := strings.HasSuffix(pattern, GLOB)
-	end := len(parts) - 1
-
-	// Go over the leading parts and ensure they match.
-	for i := 0; i < end; i++ {
-		idx := strings.Index(subj, parts[i])
+// globParser translates a glob pattern to a regular expression
+type globParser struct {
+	pattern []rune
+	pos     int
+	slash   bool
+}
 
-		switch i {
-		case 0:
-			// Check the first section. Requires special handling.
-			if !leadingGlob && idx != 0 {
-				return false
+// parse translates the pattern until the end, or until the end of the alternative when inside braces
+func (p *globParser) parse(inBraces bool) (string, error) {
+	var expr strings.Builder
+	for p.pos < len(p.pattern) {
+		c := p.pattern[p.pos]
+		switch {
+		case c == '\\':
+			if p.pos+1 >= len(p.pattern) {
+				return "", fmt.Errorf("trailing '\\'")
 			}
-		default:
-			// Check that the middle parts match.
-			if idx < 0 {
-				return false
+			expr.WriteString(regexp.QuoteMeta(string(p.pattern[p.pos+1])))
+			p.pos += 2
+		case c == '*' && p.peek(1) == '*':
+			p.pos += 2
+			// "**/" matches zero or more directories, so "**/a" matches both "a" and "x/y/a"
+			if p.peek(0) == '/' {
+				expr.WriteString(`(?:.*/)?`)
+				p.pos++
+			} else {
+				expr.WriteString(`.*`)
+			}
+		case c == '*':
+			expr.WriteString(p.any() + `*`)
+			p.pos++
+		case c == '?':
+			expr.WriteString(p.any())
+			p.pos++
+		case c == '[':
+			class, err := p.class()
+			if err != nil {
+				return "", err
 			}
+			expr.WriteString(class)
+		case c == '{':
+			p.pos++
+			var alternatives []string
+			for {
+				alt, err := p.parse(true)
+				if err != nil {
+					return "", err
+				}
+				alternatives = append(alternatives, alt)
+				if p.pos >= len(p.pattern) {
+					return "", fmt.Errorf("unclosed '{'")
+				}
+				p.pos++
+				if p.pattern[p.pos-1] == '}' {
+					break
+				}
+			}
+			expr.WriteString(`(?:` + strings.Join(alternatives, `|`) + `)`)
+		case inBraces && (c == ',' || c == '}'):
+			return expr.String(), nil
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+			p.pos++
 		}
+	}
+	return expr.String(), nil
+}
+
+// peek returns the character at offset from the current position, or 0 after the end of the pattern
+func (p *globParser) peek(offset int) rune {
+	if p.pos+offset < len(p.pattern) {
+		return p.pattern[p.pos+offset]
+	}
+	return 0
+}
 
-		// Trim evaluated text from subj as we loop over the pattern.
-		subj = subj[idx+len(parts[i]):]
+// any returns the expression that matches any single character
+func (p *globParser) any() string {
+	if p.slash {
+		return `[^/]`
 	}
+	return `.`
+}
 
-	// Reached the last section. Requires special handling.
-	return trailingGlob || strings.HasSuffix(subj, parts[end])
+// class translates a character class like [a-z] or [!abc], p.pos is at the '['
+func (p *globParser) class() (string, error) {
+	p.pos++
+	var class strings.Builder
+	class.WriteString("[")
+	if c := p.peek(0); c == '!' || c == '^' {
+		class.WriteString("^")
+		if p.slash {
+			class.WriteString("/")
+		}
+		p.pos++
+	}
+	first := true
+	for {
+		if p.pos >= len(p.pattern) {
+			return "", fmt.Errorf("unclosed '['")
+		}
+		c := p.pattern[p.pos]
+		p.pos++
+		// a ']' first in the class is a literal ']', otherwise it closes the class
+		if c == ']' && !first {
+			break
+		}
+		// a '-' between two characters is a range, first or last in the class it's a literal '-'
+		if c == '-' && !first && p.peek(0) != ']' {
+			class.WriteRune('-')
+			continue
+		}
+		first = false
+		if c == '\\' {
+			if p.pos >= len(p.pattern) {
+				return "", fmt.Errorf("unclosed '['")
+			}
+			c = p.pattern[p.pos]
+			p.pos++
+		}
+		if c < unicode.MaxASCII && (unicode.IsPunct(c) || unicode.IsSymbol(c)) {
+			class.WriteString(`\` + string(c))
+		} else {
+			class.WriteRune(c)
+		}
+	}
+	class.WriteString("]")
+	return class.String(), nil
 }
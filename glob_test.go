@@ -28,6 +28,33 @@ var globTests = []struct {
 	{"*beta*", "betagamma", true},
 	{"*beta*", "alphabetagamma", true},
 	{"*beta*", "alpha/beta/gamma", true},
+
+	{"?.txt", "a.txt", true},
+	{"?.txt", "ab.txt", false},
+	{"file[0-9].txt", "file1.txt", true},
+	{"file[0-9].txt", "filex.txt", false},
+	{"file[!0-9].txt", "filex.txt", true},
+	{"file[^0-9].txt", "file1.txt", false},
+	{"file[]].txt", "file].txt", true},
+	{"file[a-].txt", "file-.txt", true},
+	{"*.{css,js}", "site.css", true},
+	{"*.{css,js}", "site.js", true},
+	{"*.{css,js}", "site.html", false},
+	{"{assets/*.{png,jpg},*.ico}", "assets/logo.png", true},
+	{"{assets/*.{png,jpg},*.ico}", "favicon.ico", true},
+	{"{assets/*.{png,jpg},*.ico}", "assets/logo.gif", false},
+	{`\*.txt`, "*.txt", true},
+	{`\*.txt`, "a.txt", false},
+	{`file\[1\].txt`, "file[1].txt", true},
+	{"file.txt", "fileXtxt", false},
+	{"/file.txt", "file.txt", true},
+	{"**/*.bak", "a.bak", true},
+	{"**/*.bak", "dir/sub/a.bak", true},
+	{"dir/**", "dir/sub/a.bak", true},
+	{"dir/**/a.bak", "dir/a.bak", true},
+	{"dir/**/a.bak", "dir/x/y/a.bak", true},
+	{"[", "[", true}, // malformed patterns only match themselves
+	{"{a,b", "a", false},
 }
 
 func TestGlobMatch(t *testing.T) {
@@ -38,3 +65,43 @@ func TestGlobMatch(t *testing.T) {
 		}
 	}
 }
+
+func TestGlobOptions(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		opts     globOptions
+		in       string
+		expected bool
+	}{
+		{"*.bak", globOptions{Slash: true}, "a.bak", true},
+		{"*.bak", globOptions{Slash: true}, "dir/a.bak", false},
+		{"**/*.bak", globOptions{Slash: true}, "dir/sub/a.bak", true},
+		{"dir/?.bak", globOptions{Slash: true}, "dir/a.bak", true},
+		{"dir?a.bak", globOptions{Slash: true}, "dir/a.bak", false},
+		{"dir[!a]a.bak", globOptions{Slash: true}, "dir/a.bak", false},
+		{"*.bak", globOptions{Basename: true}, "dir/sub/a.bak", true},
+		{"sub", globOptions{Basename: true}, "dir/sub", true},
+		{"/sub", globOptions{Basename: true}, "dir/sub", false},
+		{"/sub", globOptions{Basename: true}, "sub", true},
+		{"dir/*.bak", globOptions{Basename: true, Slash: true}, "other/dir/a.bak", false},
+		{"*.bak", globOptions{Basename: true, Slash: true}, "dir/sub/a.bak", true},
+	}
+	for _, test := range tests {
+		g, err := compileGlob(test.pattern, test.opts)
+		if err != nil {
+			t.Errorf("compileGlob(%q) failed: %v", test.pattern, err)
+			continue
+		}
+		if actual := g.match(test.in); actual != test.expected {
+			t.Errorf("compileGlob(%q, %+v).match(%q) => %t, want %t", test.pattern, test.opts, test.in, actual, test.expected)
+		}
+	}
+}
+
+func TestGlobInvalid(t *testing.T) {
+	for _, pattern := range []string{"[abc", "{a,b", "file\\", "[\\"} {
+		if _, err := compileGlob(pattern, globOptions{}); err == nil {
+			t.Errorf("expected an error compiling %q", pattern)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// headConcurrency is the number of HeadObject calls that are made at the same time
+const headConcurrency = 16
+
+// headObjects passes on the remote files from in, and fetches the headers and metadata with HeadObject for the files
+// where needsHead returns true. The listing only has the size, modified time and ETag of objects, but some decisions
+// needs to know how an object was uploaded. The HeadObject calls are made concurrently, so the files might come out in
+// another order than they came in. If HeadObject fails the file is passed on as it was listed.
+func headObjects(config *Config, in chan *FileStat, needsHead func(*FileStat) bool, logger *Logger) chan *FileStat {
+	out := make(chan *FileStat, cap(in))
+	var wg sync.WaitGroup
+	for i := 0; i < headConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range in {
+				if file.Err == nil && needsHead(file) {
+					if err := headObject(config, file); err != nil {
+						logger.Err.Printf("Could not get the metadata of s3://%s/%s: %v\n", config.Bucket, file.Path, err)
+					}
+				}
+				out <- file
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+// headObject sets the ContentEncoding and Metadata of the file from a HeadObject call, and updates the file with
+// what the metadata says about the original file
+func headObject(config *Config, file *FileStat) error {
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(config.Bucket),
+		Key:    aws.String(file.Path),
+	}
+	config.Encryption.setHead(input)
+	head, err := config.S3Service.HeadObject(input)
+	if err != nil {
+		return err
+	}
+	file.ContentEncoding = aws.StringValue(head.ContentEncoding)
+	file.Metadata = make(map[string]string, len(head.Metadata))
+	for key, value := range head.Metadata {
+		// the sdk returns the keys in the canonical http header format, e.g. "Uncompressed-Size"
+		file.Metadata[strings.ToLower(key)] = aws.StringValue(value)
+	}
+	applyCompressionMetadata(file)
+	applyEncryptionMetadata(file)
+	// downloaded files get the LastModified time of the object, so that's what downloads compare with
+	if config.Mode != Download {
+		applyMtimeMetadata(file)
+	}
+	return nil
+}
+
+// needsMetadata returns true if the strategy decided to sync the files without the metadata of the remote file, and the
+// metadata might change that. Downloads need the metadata of the object anyway, the size of compressed objects is only
+// in the metadata.
+func needsMetadata(config *Config, strategy SyncStrategy, source, dest *FileStat) bool {
+	if remote := remoteFile(source, dest); config.Mode == Download && remote != nil && remote.Metadata == nil {
+		return true
+	}
+	return config.Mode != Download && needsMtime(strategy, source, dest) || needsEncryptionMetadata(config, source, dest)
+}
+
+// needsHead returns the function that decides which remote files needs their metadata for the sync. Downloads need
+// the metadata to restore the preserved attributes, and to recreate links that were uploaded with -symlinks metadata.
+// Objects encrypted by s3sync are compared by their size first, and only fetched by compare when that isn't enough.
+func needsHead(config *Config) func(*FileStat) bool {
+	preserve := config.Mode == Download && config.Preserve != nil
+	// empty objects might be links, their target is in the metadata
+	links := config.Mode == Download && config.Symlinks == SymlinkMetadata
+	return func(file *FileStat) bool {
+		return preserve || (links && file.Size == 0) || config.Rules.compressed(file)
+	}
+}
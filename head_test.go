@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// headMock returns the headers for HeadObject calls from a map of keys
+type headMock struct {
+	s3iface.S3API
+	heads map[string]*s3.HeadObjectOutput
+}
+
+func (m *headMock) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	if head, ok := m.heads[*input.Key]; ok {
+		return head, nil
+	}
+	return nil, awserr.NewRequestFailure(awserr.New("NotFound", "Not Found", nil), 404, "id")
+}
+
+func TestHeadObjects(t *testing.T) {
+	logger, _ := getTestLogger()
+	config := &Config{Bucket: "bucket", S3Service: &headMock{heads: map[string]*s3.HeadObjectOutput{
+		"www/site.css": {
+			ContentEncoding: aws.String("gzip"),
+			Metadata:        map[string]*string{"Uncompressed-Size": aws.String("2100"), "Uncompressed-Md5": aws.String("abc")},
+		},
+	}}}
+
+	in := make(chan *FileStat, 4)
+	in <- &FileStat{Name: "site.css", Path: "www/site.css", Size: 100, ETag: "compressed"}
+	in <- &FileStat{Name: "missing.css", Path: "www/missing.css", Size: 50}
+	in <- &FileStat{Name: "index.html", Path: "www/index.html", Size: 10}
+	close(in)
+
+	needsHead := func(file *FileStat) bool { return file.Name != "index.html" }
+	var files []*FileStat
+	for file := range headObjects(config, in, needsHead, logger) {
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+
+	if len(files) != 3 {
+		t.Fatalf("expected 3 files, got %d", len(files))
+	}
+	if files[0].Name != "index.html" || files[0].Metadata != nil {
+		t.Errorf("expected index.html without metadata, got %+v", files[0])
+	}
+	if files[1].Name != "missing.css" || files[1].Size != 50 || files[1].Metadata != nil {
+		t.Errorf("expected missing.css as it was listed, got %+v", files[1])
+	}
+	if files[2].Name != "site.css" || files[2].Size != 2100 || files[2].ETag != "abc" || files[2].ContentEncoding != "gzip" {
+		t.Errorf("expected site.css with the uncompressed size and md5, got %+v", files[2])
+	}
+}
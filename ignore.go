@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// s3syncIgnoreFile is the name of the files with patterns for files to ignore, it's read in every directory
+const s3syncIgnoreFile = ".s3syncignore"
+
+// ignoreRule is one pattern in an ignore file
+type ignoreRule struct {
+	glob *glob
+	// negate re-includes files that matches, like "!important.log"
+	negate bool
+	// dirOnly only matches directories, like "logs/"
+	dirOnly bool
+}
+
+// ignoreFiles decides which files are ignored by .s3syncignore files, and optionally .gitignore files, with the same
+// semantics as .gitignore files. The patterns in a file applies to the directory it's in and everything below it, and
+// patterns in deeper directories takes precedence. Ignore files are read from the local directory when they are first
+// needed, so the same rules can be used for remote objects as for local files. All methods are safe for concurrent
+// use and on a nil ignoreFiles, which doesn't ignore anything.
+type ignoreFiles struct {
+	// root is the local directory, empty if there's no local directory to read ignore files from
+	root string
+	// names are the names of the ignore files to read in each directory
+	names []string
+	// rootRules are patterns from -exclude-from files, they apply to the root before any ignore files
+	rootRules []ignoreRule
+	logger    *Logger
+
+	mu   sync.Mutex
+	dirs map[string][]ignoreRule
+}
+
+// newIgnoreFiles creates an ignoreFiles that reads the ignore files with the names from the directories under root
+func newIgnoreFiles(root string, names []string, logger *Logger) *ignoreFiles {
+	return &ignoreFiles{
+		root:   root,
+		names:  names,
+		logger: logger,
+		dirs:   make(map[string][]ignoreRule),
+	}
+}
+
+// addExcludeFrom adds the patterns in the file to the rules for the root
+func (ig *ignoreFiles) addExcludeFrom(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	rules, err := parseIgnore(file, path, ig.logger)
+	if err != nil {
+		return err
+	}
+	ig.rootRules = append(ig.rootRules, rules...)
+	return nil
+}
+
+// parseIgnore parses the lines of an ignore file, patterns that can't be compiled are logged and skipped
+func parseIgnore(r io.Reader, source string, logger *Logger) ([]ignoreRule, error) {
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		// trailing spaces are ignored unless they are escaped with a backslash
+		trimmed := strings.TrimRight(line, " ")
+		if strings.HasSuffix(trimmed, "\\") && len(trimmed) < len(line) {
+			trimmed += " "
+		}
+		line = trimmed
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := ignoreRule{}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		// a pattern with a slash in it is relative to the directory of the ignore file, otherwise it matches a file or
+		// directory name at any depth
+		if strings.Contains(line, "/") && !strings.HasPrefix(line, "/") {
+			line = "/" + line
+		}
+		g, err := compileGlob(line, globOptions{Slash: true, Basename: true})
+		if err != nil {
+			logger.Err.Printf("Ignoring pattern in %s: %v\n", source, err)
+			continue
+		}
+		rule.glob = g
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// rules returns the rules in the ignore files in the directory, relative to the root
+func (ig *ignoreFiles) rules(dir string) []ignoreRule {
+	if ig.root == "" {
+		return nil
+	}
+	ig.mu.Lock()
+	defer ig.mu.Unlock()
+	if rules, ok := ig.dirs[dir]; ok {
+		return rules
+	}
+	var rules []ignoreRule
+	for _, name := range ig.names {
+		path := filepath.Join(ig.root, filepath.FromSlash(dir), name)
+		file, err := os.Open(path)
+		if err != nil {
+			if !os.IsNotExist(err) && !isNotDirectory(err) {
+				ig.logger.Err.Printf("Could not read %s: %v\n", path, err)
+			}
+			continue
+		}
+		fileRules, err := parseIgnore(file, path, ig.logger)
+		_ = file.Close()
+		if err != nil {
+			ig.logger.Err.Printf("Could not read %s: %v\n", path, err)
+		}
+		rules = append(rules, fileRules...)
+	}
+	ig.dirs[dir] = rules
+	return rules
+}
+
+// ignored returns true if the file or directory with the name, relative to the root, is ignored. Nothing in a
+// directory that is ignored can be included again by a negated pattern, just like with .gitignore files.
+func (ig *ignoreFiles) ignored(name string, isDir bool) bool {
+	if ig == nil {
+		return false
+	}
+	parts := strings.Split(name, "/")
+	for i := 1; i < len(parts); i++ {
+		if ig.match(parts[:i], true) {
+			return true
+		}
+	}
+	return ig.match(parts, isDir)
+}
+
+// match returns true if the last rule that matches the path is an ignore rule, without looking at parent directories
+func (ig *ignoreFiles) match(parts []string, isDir bool) bool {
+	ignored := false
+	check := func(rules []ignoreRule, name string) {
+		for _, rule := range rules {
+			if rule.dirOnly && !isDir {
+				continue
+			}
+			if rule.glob.match(name) {
+				ignored = !rule.negate
+			}
+		}
+	}
+	check(ig.rootRules, strings.Join(parts, "/"))
+	for i := 0; i < len(parts); i++ {
+		check(ig.rules(strings.Join(parts[:i], "/")), strings.Join(parts[i:], "/"))
+	}
+	return ignored
+}
+
+// isNotDirectory returns true if the error is because a part of the path is a file and not a directory, which happens
+// when a remote object has the same name as a local file
+func isNotDirectory(err error) bool {
+	if pathErr, ok := err.(*os.PathError); ok {
+		err = pathErr.Err
+	}
+	return err != nil && strings.Contains(err.Error(), "not a directory")
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestIgnoreFiles(t *testing.T) {
+	logger, buf := getTestLogger()
+	dir, err := ioutil.TempDir("", "s3sync-ignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	files := map[string]string{
+		".s3syncignore":     "# logs\n*.log\n!keep.log\nbuild/\n/secret.txt\n",
+		"a.log":             "",
+		"keep.log":          "",
+		"secret.txt":        "",
+		"build/app.js":      "",
+		"sub/.s3syncignore": "!b.log\n*.tmp\n",
+		"sub/b.log":         "",
+		"sub/c.tmp":         "",
+		"sub/d.txt":         "",
+		"sub/secret.txt":    "",
+		"sub/build":         "",
+		"sub/.gitignore":    "d.txt\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	filter := &Filter{ignores: newIgnoreFiles(dir, []string{s3syncIgnoreFile}, logger)}
+	var found []string
+	for file := range loadLocalFiles(dir, filter, FollowSymlinks, nil, logger) {
+		if file.Err != nil {
+			t.Fatal(file.Err)
+		}
+		found = append(found, file.Name)
+	}
+	sort.Strings(found)
+	expected := ".s3syncignore keep.log sub/.gitignore sub/.s3syncignore sub/b.log sub/build sub/d.txt sub/secret.txt"
+	if strings.Join(found, " ") != expected {
+		t.Errorf("found %v, want %s", found, expected)
+		t.Errorf("%s", buf)
+	}
+
+	// remote objects are ignored by the local ignore files, even if they don't exist locally
+	remote := []struct {
+		name     string
+		expected bool
+	}{
+		{"build/other.js", true},
+		{"x.log", true},
+		{"deep/dir/x.log", true},
+		{"deep/build/x.js", true},
+		{"sub/x.tmp", true},
+		{"sub/new/b.log", false},
+		{"other/x.tmp", false},
+		{"sub/build/x.js", true},
+		{"sub/builds/x.js", false},
+	}
+	for _, test := range remote {
+		if actual := filter.excluded(test.name); actual != test.expected {
+			t.Errorf("excluded(%q) => %t, want %t", test.name, actual, test.expected)
+		}
+	}
+
+	gitignore := &Filter{ignores: newIgnoreFiles(dir, []string{s3syncIgnoreFile, ".gitignore"}, logger)}
+	if !gitignore.excluded("sub/d.txt") {
+		t.Error("expected sub/d.txt to be excluded by .gitignore")
+	}
+}
+
+func TestParseIgnore(t *testing.T) {
+	logger, _ := getTestLogger()
+	content := "# comment\n\n\\#file\n\\!file\ntrailing   \nspace\\ \n!negated\ndir/\n/anchored\na/b\n[broken\n"
+	rules, err := parseIgnore(strings.NewReader(content), "test", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		pattern string
+		negate  bool
+		dirOnly bool
+	}{
+		{name: "#file", pattern: "\\#file"},
+		{name: "!file", pattern: "\\!file"},
+		{name: "trailing", pattern: "trailing"},
+		{name: "space ", pattern: "space\\ "},
+		{name: "negated", pattern: "negated", negate: true},
+		{name: "dir", pattern: "dir", dirOnly: true},
+		{name: "anchored", pattern: "/anchored"},
+		{name: "a/b", pattern: "/a/b"},
+	}
+	if len(rules) != len(tests) {
+		t.Fatalf("got %d rules, want %d", len(rules), len(tests))
+	}
+	for i, test := range tests {
+		rule := rules[i]
+		if rule.glob.String() != test.pattern || rule.negate != test.negate || rule.dirOnly != test.dirOnly {
+			t.Errorf("rule %d is %s negate=%t dirOnly=%t, want %s negate=%t dirOnly=%t", i, rule.glob, rule.negate,
+				rule.dirOnly, test.pattern, test.negate, test.dirOnly)
+		}
+		if !rule.glob.match(test.name) {
+			t.Errorf("expected %s to match %q", rule.glob, test.name)
+		}
+	}
+	if rules[6].glob.match("sub/anchored") || rules[7].glob.match("sub/a/b") {
+		t.Error("expected patterns with a slash to be anchored")
+	}
+}
+
+func TestExcludeFrom(t *testing.T) {
+	logger, _ := getTestLogger()
+	file, err := ioutil.TempFile("", "s3sync-exclude-from")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Remove(file.Name())
+	}()
+	if _, err := file.WriteString("*.bak\n!important.bak\n"); err != nil {
+		t.Fatal(err)
+	}
+	_ = file.Close()
+
+	// without a local directory only the -exclude-from patterns are used, like when copying between buckets
+	ignores := newIgnoreFiles("", []string{s3syncIgnoreFile}, logger)
+	if err := ignores.addExcludeFrom(file.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if !ignores.ignored("dir/a.bak", false) || ignores.ignored("dir/important.bak", false) || ignores.ignored("a.txt", false) {
+		t.Error("unexpected result from the -exclude-from patterns")
+	}
+	if err := ignores.addExcludeFrom(file.Name() + ".missing"); err == nil {
+		t.Error("expected an error for a missing -exclude-from file")
+	}
+}
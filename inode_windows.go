@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "os"
+
+// fileInode returns 0 since there are no inode numbers on windows
+func fileInode(stat os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// Journal operations
+const (
+	journalStart     = "start"
+	journalPlan      = "plan"
+	journalListed    = "listed"
+	journalDone      = "done"
+	journalMultipart = "multipart"
+	journalPart      = "part"
+)
+
+// journalEntry is one line in the journal file
+type journalEntry struct {
+	Op string `json:"op"`
+	// Sync describes the source and destination for the start entry, so a journal isn't resumed for another sync
+	Sync    string    `json:"sync,omitempty"`
+	Name    string    `json:"name,omitempty"`
+	Path    string    `json:"path,omitempty"`
+	Size    int64     `json:"size,omitempty"`
+	ModTime time.Time `json:"mtime,omitempty"`
+	ETag    string    `json:"etag,omitempty"`
+	// LinkTarget is set for symbolic links that are uploaded as links
+	LinkTarget string `json:"link_target,omitempty"`
+	// ContentEncoding and Metadata are the headers of remote files, downloads need them to decompress, decrypt and
+	// restore the files
+	ContentEncoding string            `json:"content_encoding,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+	// UploadID, PartSize, Part and PartETag are used for resuming multipart uploads
+	UploadID string `json:"upload_id,omitempty"`
+	PartSize int64  `json:"part_size,omitempty"`
+	Part     int64  `json:"part,omitempty"`
+	PartETag string `json:"part_etag,omitempty"`
+}
+
+// journalUpload is a multipart upload that has been started, and the parts of it that have been uploaded
+type journalUpload struct {
+	UploadID string
+	PartSize int64
+	Size     int64
+	ModTime  time.Time
+	Parts    map[int64]string
+}
+
+// Journal records the transfers that are planned and completed during syncFiles, so that an interrupted sync can be
+// resumed without listing and comparing everything again. Multipart uploads are recorded with their UploadId and
+// completed parts so they can continue where they stopped. All methods are safe for concurrent use and are no-ops on
+// a nil Journal.
+type Journal struct {
+	path string
+
+	mu       sync.Mutex
+	file     *os.File
+	enc      *json.Encoder
+	resumed  bool
+	listed   bool
+	planned  map[string]*journalEntry
+	order    []string
+	done     map[string]bool
+	uploads  map[string]*journalUpload
+	writeErr error
+}
+
+// journalSync describes the source and destination of a sync
+func journalSync(config *Config) string {
+	dest := fmt.Sprintf("s3://%s/%s", config.Bucket, config.BucketPrefix)
+	switch config.Mode {
+	case Download:
+		return fmt.Sprintf("%s %s %s", config.Mode, dest, config.LocalPath)
+	case Copy:
+		return fmt.Sprintf("%s s3://%s/%s %s", config.Mode, config.Source.Bucket, config.Source.BucketPrefix, dest)
+	}
+	return fmt.Sprintf("%s %s %s", config.Mode, config.LocalPath, dest)
+}
+
+// newJournal creates a new, empty journal at path for the sync described by config. The multipart uploads of a
+// journal that is replaced would never be completed or aborted, so they are aborted first.
+func newJournal(path string, config *Config) (*Journal, error) {
+	if err := abortJournalUploads(path, config); err != nil {
+		return nil, err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	j := &Journal{
+		path:    path,
+		file:    file,
+		enc:     json.NewEncoder(file),
+		planned: make(map[string]*journalEntry),
+		done:    make(map[string]bool),
+		uploads: make(map[string]*journalUpload),
+	}
+	j.write(&journalEntry{Op: journalStart, Sync: journalSync(config)})
+	return j, j.writeErr
+}
+
+// resumeJournal reads the journal at path and opens it for appending. It fails if the journal was written for a
+// different source or destination.
+func resumeJournal(path string, config *Config) (*Journal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	j, syncOf, err := readJournal(path, file)
+	if err == nil && syncOf != journalSync(config) {
+		err = fmt.Errorf("journal %s is for '%s', not '%s'", path, syncOf, journalSync(config))
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	j.resumed = true
+	return j, nil
+}
+
+// abortJournalUploads aborts the multipart uploads that were started but not completed in an existing journal at
+// path. A journal for another sync has uploads in another bucket or prefix, it's left for -resume or to be removed.
+func abortJournalUploads(path string, config *Config) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	j, syncOf, err := readJournal(path, file)
+	_ = file.Close()
+	if err != nil || len(j.uploads) == 0 {
+		// a file that isn't a journal is overwritten, like any other file given to -journal
+		return nil
+	}
+	if syncOf != journalSync(config) {
+		return fmt.Errorf("journal %s has unfinished multipart uploads for '%s', resume that sync or remove the journal", path, syncOf)
+	}
+	for name, upload := range j.uploads {
+		_, err := config.S3Service.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(config.Bucket),
+			Key:      aws.String(objectKey(config.BucketPrefix, name)),
+			UploadId: aws.String(upload.UploadID),
+		})
+		if err != nil && !isNoSuchUpload(err) {
+			return fmt.Errorf("could not abort the multipart upload of %s from journal %s: %v", name, path, err)
+		}
+	}
+	return nil
+}
+
+// readJournal reads the entries of the journal in file, and returns them together with the sync the journal is for
+func readJournal(path string, file *os.File) (*Journal, string, error) {
+	j := &Journal{
+		path:    path,
+		file:    file,
+		enc:     json.NewEncoder(file),
+		planned: make(map[string]*journalEntry),
+		done:    make(map[string]bool),
+		uploads: make(map[string]*journalUpload),
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var syncOf string
+	started := false
+	for scanner.Scan() {
+		var entry journalEntry
+		// the last line might be half written if the previous run was killed, it's safe to skip
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		switch entry.Op {
+		case journalStart:
+			syncOf = entry.Sync
+			started = true
+		case journalPlan:
+			e := entry
+			if _, ok := j.planned[e.Name]; !ok {
+				j.order = append(j.order, e.Name)
+			}
+			j.planned[e.Name] = &e
+		case journalListed:
+			j.listed = true
+		case journalDone:
+			j.done[entry.Name] = true
+			delete(j.uploads, entry.Name)
+		case journalMultipart:
+			j.uploads[entry.Name] = &journalUpload{
+				UploadID: entry.UploadID,
+				PartSize: entry.PartSize,
+				Size:     entry.Size,
+				ModTime:  entry.ModTime,
+				Parts:    make(map[int64]string),
+			}
+		case journalPart:
+			if upload, ok := j.uploads[entry.Name]; ok && upload.UploadID == entry.UploadID {
+				upload.Parts[entry.Part] = entry.PartETag
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, "", err
+	}
+	if !started {
+		return nil, "", fmt.Errorf("%s is not a s3sync journal", path)
+	}
+	return j, syncOf, nil
+}
+
+// write appends an entry to the journal file, j.mu must be held or j not yet shared
+func (j *Journal) write(entry *journalEntry) {
+	if err := j.enc.Encode(entry); err != nil && j.writeErr == nil {
+		j.writeErr = err
+	}
+}
+
+// completeListing returns true if the journal that was resumed has every file that needs syncing, so the source and
+// destination don't have to be listed and compared again
+func (j *Journal) completeListing() bool {
+	if j == nil {
+		return false
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.resumed && j.listed
+}
+
+// pending returns the files that were planned but not completed in the journal that was resumed
+func (j *Journal) pending(config *Config) chan *FileStat {
+	out := make(chan *FileStat)
+	go func() {
+		defer close(out)
+		j.mu.Lock()
+		var files []*FileStat
+		for _, name := range j.order {
+			if j.done[name] {
+				continue
+			}
+			entry := j.planned[name]
+			file := &FileStat{
+				Name:            entry.Name,
+				Path:            entry.Path,
+				Size:            entry.Size,
+				ModTime:         entry.ModTime,
+				ETag:            entry.ETag,
+				LinkTarget:      entry.LinkTarget,
+				ContentEncoding: entry.ContentEncoding,
+				Metadata:        entry.Metadata,
+			}
+			// local files might have changed since they were planned, the current content is what should be uploaded
+			if config.Mode == Upload && file.LinkTarget != "" {
+				if target, err := os.Readlink(file.Path); err == nil {
+					file.LinkTarget = target
+				}
+			} else if config.Mode == Upload {
+				if stat, err := os.Stat(file.Path); err == nil {
+					file.Size = stat.Size()
+					file.ModTime = stat.ModTime()
+				}
+			}
+			files = append(files, file)
+		}
+		j.mu.Unlock()
+		for _, file := range files {
+			config.Progress.queued(file)
+			out <- file
+		}
+		config.Progress.listed()
+	}()
+	return out
+}
+
+// plan records that a file is about to be transferred, it's not recorded again when resuming
+func (j *Journal) plan(file *FileStat) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, ok := j.planned[file.Name]; ok {
+		return
+	}
+	entry := &journalEntry{
+		Op:              journalPlan,
+		Name:            file.Name,
+		Path:            file.Path,
+		Size:            file.Size,
+		ModTime:         file.ModTime,
+		ETag:            file.ETag,
+		LinkTarget:      file.LinkTarget,
+		ContentEncoding: file.ContentEncoding,
+		Metadata:        file.Metadata,
+	}
+	j.planned[file.Name] = entry
+	j.order = append(j.order, file.Name)
+	j.write(entry)
+}
+
+// markListed records that every file that needs syncing has been planned
+func (j *Journal) markListed() {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if !j.listed {
+		j.listed = true
+		j.write(&journalEntry{Op: journalListed})
+	}
+}
+
+// complete records that a file has been transferred
+func (j *Journal) complete(file *FileStat) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.done[file.Name] = true
+	delete(j.uploads, file.Name)
+	j.write(&journalEntry{Op: journalDone, Name: file.Name})
+}
+
+// multipartUpload returns the multipart upload that was started for the file, if the file hasn't changed since
+func (j *Journal) multipartUpload(file *FileStat, partSize int64) *journalUpload {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	upload, ok := j.uploads[file.Name]
+	if !ok || upload.Size != file.Size || !upload.ModTime.Equal(file.ModTime) || upload.PartSize != partSize {
+		return nil
+	}
+	parts := make(map[int64]string, len(upload.Parts))
+	for n, etag := range upload.Parts {
+		parts[n] = etag
+	}
+	return &journalUpload{UploadID: upload.UploadID, PartSize: upload.PartSize, Size: upload.Size, ModTime: upload.ModTime, Parts: parts}
+}
+
+// startMultipart records that a multipart upload has been created for the file
+func (j *Journal) startMultipart(file *FileStat, uploadID string, partSize int64) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.uploads[file.Name] = &journalUpload{UploadID: uploadID, PartSize: partSize, Size: file.Size, ModTime: file.ModTime, Parts: make(map[int64]string)}
+	j.write(&journalEntry{Op: journalMultipart, Name: file.Name, UploadID: uploadID, PartSize: partSize, Size: file.Size, ModTime: file.ModTime})
+}
+
+// completePart records that a part of a multipart upload has been uploaded
+func (j *Journal) completePart(file *FileStat, uploadID string, part int64, etag string) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if upload, ok := j.uploads[file.Name]; ok && upload.UploadID == uploadID {
+		upload.Parts[part] = etag
+	}
+	j.write(&journalEntry{Op: journalPart, Name: file.Name, UploadID: uploadID, Part: part, PartETag: etag})
+}
+
+// forgetMultipart removes a multipart upload that can't be continued, e.g. because it has been aborted
+func (j *Journal) forgetMultipart(file *FileStat) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	delete(j.uploads, file.Name)
+}
+
+// close closes the journal file, and removes it if remove is true
+func (j *Journal) close(remove bool) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	err := j.file.Close()
+	if remove {
+		return os.Remove(j.path)
+	}
+	if err == nil {
+		err = j.writeErr
+	}
+	return err
+}
+
+// resumableUpload uploads a file as a multipart upload that is recorded in the journal, so that an interrupted upload
+// continues with the parts that are missing instead of starting over. Unlike s3manager it doesn't abort the upload when
+// a part fails, since the parts that have been uploaded are needed when resuming.
+func resumableUpload(config *Config, fileStat *FileStat, file *os.File, input *s3manager.UploadInput) error {
+	partSize := config.PartSize
+	if partSize < s3manager.MinUploadPartSize {
+		partSize = s3manager.MinUploadPartSize
+	}
+	for fileStat.Size/partSize >= int64(s3manager.MaxUploadParts) {
+		partSize *= 2
+	}
+
+	uploadID, parts, err := resumeMultipart(config, fileStat, input, partSize)
+	if err != nil {
+		return err
+	}
+	if uploadID == "" {
+		create := &s3.CreateMultipartUploadInput{}
+		awsutil.Copy(create, uploadInputWithoutBody(input))
+		resp, err := config.S3Service.CreateMultipartUpload(create)
+		if err != nil {
+			return err
+		}
+		uploadID = *resp.UploadId
+		config.Journal.startMultipart(fileStat, uploadID, partSize)
+	}
+
+	numParts := (fileStat.Size + partSize - 1) / partSize
+	concurrency := config.PartConcurrency
+	if concurrency < 1 {
+		concurrency = s3manager.DefaultUploadConcurrency
+	}
+	var mu sync.Mutex
+	var firstErr error
+	sem := make(chan bool, concurrency)
+	var wg sync.WaitGroup
+	for n := int64(1); n <= numParts; n++ {
+		offset := (n - 1) * partSize
+		size := min64(partSize, fileStat.Size-offset)
+		mu.Lock()
+		_, uploaded := parts[n]
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+		if uploaded {
+			config.Progress.transferred(size)
+			continue
+		}
+		sem <- true
+		wg.Add(1)
+		go func(n, offset, size int64) {
+			defer func() { <-sem; wg.Done() }()
+			part := &s3.UploadPartInput{}
+			awsutil.Copy(part, uploadInputWithoutBody(input))
+			part.UploadId = aws.String(uploadID)
+			part.PartNumber = aws.Int64(n)
+			part.Body = io.NewSectionReader(file, offset, size)
+			resp, err := config.S3Service.UploadPart(part)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			parts[n] = *resp.ETag
+			config.Journal.completePart(fileStat, uploadID, n, *resp.ETag)
+			config.Progress.transferred(size)
+		}(n, offset, size)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		forgetIfMissing(config, fileStat, firstErr)
+		return firstErr
+	}
+
+	completed := make([]*s3.CompletedPart, 0, len(parts))
+	for n := int64(1); n <= numParts; n++ {
+		completed = append(completed, &s3.CompletedPart{PartNumber: aws.Int64(n), ETag: aws.String(parts[n])})
+	}
+	_, err = config.S3Service.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          input.Bucket,
+		Key:             input.Key,
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+		RequestPayer:    input.RequestPayer,
+	})
+	forgetIfMissing(config, fileStat, err)
+	if err != nil {
+		return err
+	}
+	return tagMultipartUpload(config, input)
+}
+
+// resumeMultipart returns the UploadId and the uploaded parts of a multipart upload in the journal for the file. Parts
+// are only reused if s3 still has them with the same ETag, and if the upload is gone an empty UploadId is returned so
+// that a new upload is started.
+func resumeMultipart(config *Config, fileStat *FileStat, input *s3manager.UploadInput, partSize int64) (string, map[int64]string, error) {
+	parts := make(map[int64]string)
+	upload := config.Journal.multipartUpload(fileStat, partSize)
+	if upload == nil {
+		return "", parts, nil
+	}
+	err := config.S3Service.ListPartsPages(&s3.ListPartsInput{
+		Bucket:       input.Bucket,
+		Key:          input.Key,
+		UploadId:     aws.String(upload.UploadID),
+		RequestPayer: input.RequestPayer,
+	}, func(page *s3.ListPartsOutput, lastPage bool) bool {
+		for _, part := range page.Parts {
+			if etag, ok := upload.Parts[*part.PartNumber]; ok && etag == *part.ETag {
+				parts[*part.PartNumber] = etag
+			}
+		}
+		return true
+	})
+	if isNoSuchUpload(err) {
+		config.Journal.forgetMultipart(fileStat)
+		return "", make(map[int64]string), nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return upload.UploadID, parts, nil
+}
+
+// forgetIfMissing removes the multipart upload for the file from the journal if err says that it doesn't exist
+// anymore, e.g. it has been aborted by a lifecycle rule, so the next attempt starts a new upload
+func forgetIfMissing(config *Config, fileStat *FileStat, err error) {
+	if isNoSuchUpload(err) {
+		config.Journal.forgetMultipart(fileStat)
+	}
+}
+
+func isNoSuchUpload(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == s3.ErrCodeNoSuchUpload
+}
+
+// uploadInputWithoutBody returns a copy of input without the Body, so that the rest of the fields can be copied to the
+// inputs of the multipart upload calls
+func uploadInputWithoutBody(input *s3manager.UploadInput) *s3manager.UploadInput {
+	in := *input
+	in.Body = nil
+	return &in
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+func TestJournalResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3sync-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	path := filepath.Join(dir, "journal")
+	config := &Config{Mode: Download, Bucket: "bucket", BucketPrefix: "www", LocalPath: "/var/www"}
+	now := time.Now().Round(time.Second)
+
+	j, err := newJournal(path, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &FileStat{Name: "a.html", Path: "www/a.html", Size: 1, ModTime: now}
+	b := &FileStat{Name: "b.html", Path: "www/b.html", Size: 2, ModTime: now}
+	c := &FileStat{Name: "c.zip", Path: "www/c.zip", Size: 20, ModTime: now}
+	j.plan(a)
+	j.plan(b)
+	j.plan(c)
+	j.markListed()
+	j.complete(a)
+	j.startMultipart(c, "upload-1", 10)
+	j.completePart(c, "upload-1", 1, "etag-1")
+	if err := j.close(false); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err = resumeJournal(path, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !j.completeListing() {
+		t.Error("expected the resumed journal to have a complete listing")
+	}
+	var pending []string
+	for file := range j.pending(config) {
+		pending = append(pending, file.Name)
+	}
+	if len(pending) != 2 || pending[0] != "b.html" || pending[1] != "c.zip" {
+		t.Errorf("pending files are %v, want [b.html c.zip]", pending)
+	}
+
+	upload := j.multipartUpload(c, 10)
+	if upload == nil || upload.UploadID != "upload-1" || upload.Parts[1] != "etag-1" || len(upload.Parts) != 1 {
+		t.Errorf("multipart upload is %+v, want upload-1 with part 1", upload)
+	}
+	if j.multipartUpload(c, 20) != nil {
+		t.Error("expected no multipart upload with another part size")
+	}
+	if j.multipartUpload(&FileStat{Name: "c.zip", Size: 21, ModTime: now}, 10) != nil {
+		t.Error("expected no multipart upload for a changed file")
+	}
+
+	if err := j.close(true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the journal to be removed, stat gave %v", err)
+	}
+}
+
+func TestJournalOtherSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3sync-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	path := filepath.Join(dir, "journal")
+
+	j, err := newJournal(path, &Config{Mode: Upload, Bucket: "bucket", LocalPath: "/var/www"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.plan(&FileStat{Name: "a.html"})
+	if err := j.close(false); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := resumeJournal(path, &Config{Mode: Upload, Bucket: "other", LocalPath: "/var/www"}); err == nil {
+		t.Error("expected an error resuming a journal for another bucket")
+	}
+	j, err = resumeJournal(path, &Config{Mode: Upload, Bucket: "bucket", LocalPath: "/var/www"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = j.close(false)
+	}()
+	if j.completeListing() {
+		t.Error("expected an incomplete listing when the journal wasn't marked as listed")
+	}
+}
+
+func TestJournalResumeDownload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3sync-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	logger, _ := getTestLogger()
+	path := filepath.Join(dir, "journal")
+	content := []byte("body { color: red; }")
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	_, _ = w.Write(content)
+	_ = w.Close()
+	config := &Config{
+		Mode:         Download,
+		Bucket:       "bucket",
+		BucketPrefix: "www",
+		LocalPath:    filepath.Join(dir, "www"),
+		S3Service:    &getMock{objects: map[string][]byte{"www/site.css": compressed.Bytes()}},
+	}
+
+	j, err := newJournal(path, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.plan(&FileStat{
+		Name:            "site.css",
+		Path:            "www/site.css",
+		Size:            int64(len(content)),
+		ModTime:         time.Now().Round(time.Second),
+		ContentEncoding: compressGzip,
+		Metadata:        map[string]string{metaUncompressedSize: strconv.Itoa(len(content))},
+	})
+	j.markListed()
+	if err := j.close(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// the resumed download has to decompress the object like the download before the interruption would have
+	if config.Journal, err = resumeJournal(path, config); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = config.Journal.close(false)
+	}()
+	for file := range config.Journal.pending(config) {
+		if err := download(config, file, logger); err != nil {
+			t.Fatal(err)
+		}
+	}
+	downloaded, err := ioutil.ReadFile(filepath.Join(dir, "www", "site.css"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(downloaded, content) {
+		t.Errorf("expected the resumed download to be decompressed, got %q", downloaded)
+	}
+}
+
+// abortMock records the multipart uploads that are aborted
+type abortMock struct {
+	s3iface.S3API
+	aborted []string
+}
+
+func (m *abortMock) AbortMultipartUpload(input *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+	m.aborted = append(m.aborted, *input.Key+" "+*input.UploadId)
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func TestNewJournalAbortsUploads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3sync-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	path := filepath.Join(dir, "journal")
+	mock := &abortMock{}
+	config := &Config{Mode: Upload, Bucket: "bucket", BucketPrefix: "www", LocalPath: "/var/www", S3Service: mock}
+
+	j, err := newJournal(path, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := &FileStat{Name: "big.zip", Size: 20}
+	done := &FileStat{Name: "done.zip", Size: 20}
+	j.startMultipart(big, "upload-1", 10)
+	j.startMultipart(done, "upload-2", 10)
+	j.complete(done)
+	if err := j.close(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// a journal for another sync isn't replaced, its uploads are in another bucket
+	if _, err := newJournal(path, &Config{Mode: Upload, Bucket: "other", LocalPath: "/var/www", S3Service: mock}); err == nil {
+		t.Error("expected an error replacing a journal with uploads for another sync")
+	}
+	if len(mock.aborted) != 0 {
+		t.Errorf("expected no aborted uploads, got %v", mock.aborted)
+	}
+
+	j, err = newJournal(path, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = j.close(false)
+	}()
+	if len(mock.aborted) != 1 || mock.aborted[0] != "www/big.zip upload-1" {
+		t.Errorf("expected the unfinished upload to be aborted, got %v", mock.aborted)
+	}
+}
+
+// multipartMock is a bucket with one multipart upload, it records the calls of a resumed upload
+type multipartMock struct {
+	s3iface.S3API
+	// listed are the parts that ListParts returns, if nil the upload doesn't exist anymore
+	listed []*s3.Part
+
+	mu        sync.Mutex
+	created   int
+	uploaded  []int64
+	completed []*s3.CompletedPart
+}
+
+func (m *multipartMock) ListPartsPages(input *s3.ListPartsInput, fn func(*s3.ListPartsOutput, bool) bool) error {
+	if m.listed == nil {
+		return awserr.New(s3.ErrCodeNoSuchUpload, "The specified upload does not exist", nil)
+	}
+	fn(&s3.ListPartsOutput{Parts: m.listed}, true)
+	return nil
+}
+
+func (m *multipartMock) CreateMultipartUpload(*s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.created++
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload-2")}, nil
+}
+
+func (m *multipartMock) UploadPart(input *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	if _, err := io.Copy(ioutil.Discard, input.Body); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.uploaded = append(m.uploaded, *input.PartNumber)
+	return &s3.UploadPartOutput{ETag: aws.String(fmt.Sprintf("new-%d", *input.PartNumber))}, nil
+}
+
+func (m *multipartMock) CompleteMultipartUpload(input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	m.completed = input.MultipartUpload.Parts
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func TestResumableUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3sync-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	// three parts, the last one short
+	partSize := int64(s3manager.MinUploadPartSize)
+	local := filepath.Join(dir, "big.zip")
+	if err := ioutil.WriteFile(local, make([]byte, 2*partSize+10), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file := &FileStat{Name: "big.zip", Path: local, Size: 2*partSize + 10, ModTime: time.Now().Round(time.Second)}
+
+	tests := map[string]struct {
+		listed    []*s3.Part
+		created   int
+		uploaded  []int64
+		completed []string
+	}{
+		// part 2 was uploaded again with other content after the journal was written, so it can't be reused
+		"resumed": {
+			listed:    []*s3.Part{{PartNumber: aws.Int64(1), ETag: aws.String("etag-1")}, {PartNumber: aws.Int64(2), ETag: aws.String("other")}},
+			uploaded:  []int64{2, 3},
+			completed: []string{"etag-1", "new-2", "new-3"},
+		},
+		"aborted": {
+			created:   1,
+			uploaded:  []int64{1, 2, 3},
+			completed: []string{"new-1", "new-2", "new-3"},
+		},
+	}
+	for name, test := range tests {
+		path := filepath.Join(dir, name+".journal")
+		mock := &multipartMock{listed: test.listed}
+		config := &Config{Mode: Upload, Bucket: "bucket", BucketPrefix: "www", LocalPath: dir, PartSize: partSize, S3Service: mock}
+		j, err := newJournal(path, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		j.plan(file)
+		j.startMultipart(file, "upload-1", partSize)
+		j.completePart(file, "upload-1", 1, "etag-1")
+		j.completePart(file, "upload-1", 2, "etag-2")
+		if err := j.close(false); err != nil {
+			t.Fatal(err)
+		}
+
+		if config.Journal, err = resumeJournal(path, config); err != nil {
+			t.Fatal(err)
+		}
+		content, err := os.Open(local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = resumableUpload(config, file, content, &s3manager.UploadInput{Bucket: aws.String("bucket"), Key: aws.String("www/big.zip")})
+		_ = content.Close()
+		_ = config.Journal.close(false)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", name, err)
+			continue
+		}
+
+		sort.Slice(mock.uploaded, func(i, j int) bool { return mock.uploaded[i] < mock.uploaded[j] })
+		if mock.created != test.created || fmt.Sprint(mock.uploaded) != fmt.Sprint(test.uploaded) {
+			t.Errorf("%s: expected %d new uploads and the parts %v to be uploaded, got %d and %v", name, test.created, test.uploaded, mock.created, mock.uploaded)
+		}
+		var completed []string
+		for i, part := range mock.completed {
+			if *part.PartNumber != int64(i+1) {
+				t.Errorf("%s: part %d is number %d", name, i+1, *part.PartNumber)
+			}
+			completed = append(completed, *part.ETag)
+		}
+		if fmt.Sprint(completed) != fmt.Sprint(test.completed) {
+			t.Errorf("%s: expected the upload to be completed with %v, got %v", name, test.completed, completed)
+		}
+	}
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 )
 
-func loadLocalFiles(basePath string, exclude StringSlice, logger *Logger) chan *FileStat {
+// loadLocalFiles walks the basePath and sends all files that are included by the filter on the returned channel. If a
+// cache is passed in, files that haven't changed since the last run will get their checksum from it. Symbolic links are
+// followed, skipped or sent as links depending on the symlinks policy.
+func loadLocalFiles(basePath string, filter *Filter, symlinks SymlinkPolicy, cache *StateCache, logger *Logger) chan *FileStat {
 
 	out := make(chan *FileStat)
 
@@ -20,7 +24,7 @@ func loadLocalFiles(basePath string, exclude StringSlice, logger *Logger) chan *
 
 		stat, err := os.Stat(basePath)
 		if err != nil {
-			logger.Err.Printf("%s\n", err)
+			out <- &FileStat{Err: err}
 			return
 		}
 
@@ -31,52 +35,121 @@ func loadLocalFiles(basePath string, exclude StringSlice, logger *Logger) chan *
 		}
 
 		if !stat.IsDir() {
-			out <- &FileStat{
+			file := &FileStat{
 				Name:    filepath.Base(basePath),
 				Path:    absPath,
 				ModTime: stat.ModTime(),
 				Size:    stat.Size(),
+				Inode:   fileInode(stat),
 			}
+			cache.lookup(file)
+			out <- file
 			return
 		}
 
-		err = filepath.Walk(basePath, func(filePath string, stat os.FileInfo, err error) error {
+		w := &localWalker{basePath: basePath, filter: filter, symlinks: symlinks, cache: cache, out: out, logger: logger}
+		w.walk(basePath, []os.FileInfo{stat})
+
+		logger.Debug.Printf("read local - end, it took %s", time.Since(start))
+	}()
+
+	return out
+}
+
+// localWalker walks a directory tree like filepath.Walk, but also handles symbolic links to files and directories
+type localWalker struct {
+	basePath string
+	filter   *Filter
+	symlinks SymlinkPolicy
+	cache    *StateCache
+	out      chan *FileStat
+	logger   *Logger
+}
 
-			relativePath := relativePath(basePath, filepath.ToSlash(filePath))
-			for _, pattern := range exclude {
-				if globMatch(pattern, relativePath) {
-					logger.Debug.Printf("excluding %s\n", relativePath)
-					if stat.IsDir() {
-						return filepath.SkipDir
-					}
-					return nil
+// walk sends the files in dir and its subdirectories, ancestors are the directories from the basePath down to dir and
+// are used to detect links that would make the walk loop forever
+func (w *localWalker) walk(dir string, ancestors []os.FileInfo) {
+	// a directory we couldn't read is reported so that we don't think its files have been removed
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		w.out <- &FileStat{Err: err}
+		return
+	}
+
+	for _, stat := range entries {
+		filePath := filepath.Join(dir, stat.Name())
+		relativePath := relativePath(w.basePath, filepath.ToSlash(filePath))
+
+		linkTarget := ""
+		if stat.Mode()&os.ModeSymlink != 0 {
+			switch w.symlinks {
+			case SkipSymlinks:
+				w.logger.Debug.Printf("skipping the link %s\n", relativePath)
+				continue
+			case SymlinkMetadata:
+				if linkTarget, err = os.Readlink(filePath); err != nil {
+					w.out <- &FileStat{Err: err}
+					continue
 				}
-			}
-			if stat == nil || stat.IsDir() {
-				return nil
-			}
-			absPath, err := filepath.Abs(filePath)
-			if err != nil {
-				out <- &FileStat{
-					Err: err,
+			default:
+				target, err := os.Stat(filePath)
+				if err != nil {
+					w.logger.Err.Printf("skipping the broken link %s: %s\n", relativePath, err)
+					continue
 				}
+				stat = target
 			}
-			out <- &FileStat{
-				Name:    relativePath,
-				Path:    absPath,
-				ModTime: stat.ModTime(),
-				Size:    stat.Size(),
+		}
+
+		if stat.IsDir() {
+			if w.filter.skipDir(relativePath) {
+				w.logger.Debug.Printf("excluding %s\n", relativePath)
+				continue
 			}
-			return nil
-		})
+			if loops(stat, ancestors) {
+				w.logger.Err.Printf("skipping the link %s, it points to a directory that contains it\n", relativePath)
+				continue
+			}
+			w.walk(filePath, append(ancestors[:len(ancestors):len(ancestors)], stat))
+			continue
+		}
+		if w.filter.excluded(relativePath) {
+			w.logger.Debug.Printf("excluding %s\n", relativePath)
+			continue
+		}
+		absPath, err := filepath.Abs(filePath)
 		if err != nil {
-			logger.Err.Println(err)
+			w.out <- &FileStat{
+				Err: err,
+			}
+			continue
 		}
+		file := &FileStat{
+			Name:       relativePath,
+			Path:       absPath,
+			ModTime:    stat.ModTime(),
+			Size:       stat.Size(),
+			Inode:      fileInode(stat),
+			LinkTarget: linkTarget,
+		}
+		if linkTarget != "" {
+			// the object of a link is empty, its target is stored in the metadata
+			file.Size = 0
+		} else {
+			w.cache.lookup(file)
+		}
+		w.out <- file
+	}
+}
 
-		logger.Debug.Printf("read local - end, it took %s", time.Since(start))
-	}()
-
-	return out
+// loops returns true if the directory is one of the ancestors, walking it would never end
+func loops(stat os.FileInfo, ancestors []os.FileInfo) bool {
+	for _, ancestor := range ancestors {
+		if os.SameFile(stat, ancestor) {
+			return true
+		}
+	}
+	return false
 }
 
 func relativePath(path string, filePath string) string {
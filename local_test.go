@@ -9,8 +9,7 @@ import (
 func TestLoadAllLocalFiles(t *testing.T) {
 	logger, buf := getTestLogger()
 
-	var exclude StringSlice
-	fileChan := loadLocalFiles("./_testdata", exclude, logger)
+	fileChan := loadLocalFiles("./_testdata", nil, FollowSymlinks, nil, logger)
 
 	files := sink(fileChan)
 
@@ -46,15 +45,14 @@ func TestLoadAllLocalFiles(t *testing.T) {
 
 func BenchmarkLoadAllLocalFiles(b *testing.B) {
 	logger, _ := getTestLogger()
-	var exclude StringSlice
 	for i := 0; i < b.N; i++ {
-		loadLocalFiles("./_testdata", exclude, logger)
+		loadLocalFiles("./_testdata", nil, FollowSymlinks, nil, logger)
 	}
 }
 
 func TestLoadSingleFile(t *testing.T) {
 	logger, buf := getTestLogger()
-	fileChan := loadLocalFiles("./_testdata/file_33.html", StringSlice{}, logger)
+	fileChan := loadLocalFiles("./_testdata/file_33.html", &Filter{}, FollowSymlinks, nil, logger)
 	files := sink(fileChan)
 	if len(files) != 1 {
 		t.Errorf("wanted %d files, got %d files", 1, len(files))
@@ -72,22 +70,26 @@ func TestLoadSingleFile(t *testing.T) {
 
 func TestLoadFiles(t *testing.T) {
 	tests := []struct {
-		in      string
-		out     int
-		exclude StringSlice
+		in     string
+		out    int
+		filter *Filter
 	}{
 		{in: "./_testdata/dir_45", out: 13},
 		{in: "./_testdata/dir_45/", out: 13},
 		{in: "./_testdata/XXX_SDASD", out: 0},
 		{in: "./_testdata/file_33.html", out: 1},
-		{in: "./_testdata", out: 0, exclude: StringSlice{"*"}},
-		{in: "./_testdata", out: 11, exclude: StringSlice{"*.html"}},
-		{in: "./_testdata", out: 6, exclude: StringSlice{"*dir_45*"}},
+		{in: "./_testdata", out: 0, filter: testFilter("-*")},
+		{in: "./_testdata", out: 11, filter: testFilter("-*.html")},
+		{in: "./_testdata", out: 6, filter: testFilter("-*dir_45*")},
+		{in: "./_testdata", out: 8, filter: testFilter("-*", "+*.html")},
+		{in: "./_testdata", out: 4, filter: testFilter("-*", "+*.html", "-dir_45")},
+		{in: "./_testdata", out: 2, filter: testFilter("-*", "+dir_45/dir_1")},
+		{in: "./_testdata", out: 17, filter: testFilter("-dir_45/dir_*", "+*.gz")},
 	}
 
 	for _, test := range tests {
 		logger, buf := getTestLogger()
-		fileChan := loadLocalFiles(test.in, test.exclude, logger)
+		fileChan := loadLocalFiles(test.in, test.filter, FollowSymlinks, nil, logger)
 		files := sink(fileChan)
 		if len(files) != test.out {
 			t.Errorf("wanted %d files, got %d files", test.out, len(files))
@@ -115,3 +117,15 @@ func getTestLogger() (*Logger, *bytes.Buffer) {
 		Debug: log.New(buf, "[DEBUG] ", log.Lshortfile),
 	}, buf
 }
+
+// testFilter creates a Filter from patterns that starts with + for include and - for exclude
+func testFilter(patterns ...string) *Filter {
+	filter := &Filter{}
+	for _, pattern := range patterns {
+		filter.add(pattern[0] == '+', pattern[1:])
+	}
+	if err := filter.compile(globOptions{}); err != nil {
+		panic(err)
+	}
+	return filter
+}
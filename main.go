@@ -1,17 +1,24 @@
 package main
 
 import (
+	"errors"
 	"flag"
-	"net/http"
+	"fmt"
+	"io"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
@@ -19,142 +26,668 @@ import (
 func main() {
 	dryrun := flag.Bool("dryrun", false, "Displays the operations that would be performed using the specified command without actually running them.")
 	debug := flag.Bool("debug", false, "Turn on debug logging.")
+	output := flag.String("output", "text", "The output format, 'text' or 'json'. With json every event is printed as a JSON object on its own line.")
+	progress := flag.Bool("progress", false, "Show the number of files and bytes transferred, the throughput and the estimated time left. When stdout isn't a terminal a progress line is printed every 10 seconds.")
 	onlyShowErrors := flag.Bool("only-show-errors", false, "Only errors and warnings are displayed. All other output is suppressed.")
 	region := flag.String("region", "", "The region to use. Overrides config/env settings.")
 	profile := flag.String("profile", "", "Use a specific profile from your credential file.")
-	var exclude StringSlice
-	flag.Var(&exclude, "exclude", "Exclude all files or objects from the command that matches the specified pattern, only supports '*' globbing.")
+	sizeOnly := flag.Bool("size-only", false, "Makes the size of each file the only criteria used to decide whether to sync.")
+	exactTimestamps := flag.Bool("exact-timestamps", false, "Files with the same size are synced unless their modified times are exactly the same, even if the destination is newer.")
+	checksum := flag.Bool("checksum", false, "Files with the same size are only synced if their content is different, by comparing the md5 of local files with the ETag of s3 objects.")
+	ignoreExisting := flag.Bool("ignore-existing", false, "Only sync files that doesn't exist in the destination, never overwrite existing files.")
+	cacheFile := flag.String("cache-file", "", "Keep the checksums of local files in this file between runs, so that unchanged files don't have to be read again with -checksum.")
+	rebuildCache := flag.Bool("rebuild-cache", false, "Ignore the current content of the -cache-file and rebuild it.")
+	existing := flag.Bool("existing", false, "Only update files that already exist in the destination, never create new files.")
+	sourceRegion := flag.String("source-region", "", "The region of the source bucket when syncing between buckets. Defaults to -region.")
+	sse := flag.String("sse", "", "Encrypt uploaded and copied objects with server side encryption, AES256 for keys managed by s3 or aws:kms for keys in KMS.")
+	sseKMSKeyID := flag.String("sse-kms-key-id", "", "The KMS key that objects are encrypted with when -sse is aws:kms. Defaults to the aws managed key for s3.")
+	sseC := flag.Bool("sse-c", false, "Encrypt uploaded and copied objects with the customer provided key in -sse-c-key. The same key is needed to download them.")
+	sseCKey := flag.String("sse-c-key", "", "The 256 bit key for -sse-c, either the 32 bytes, the bytes base64 encoded or file://path to read it from a file.")
+	sourceSSECKey := flag.String("source-sse-c-key", "", "The customer provided key of the objects in the source bucket when syncing between buckets, in the same format as -sse-c-key.")
+	clientKey := flag.String("client-encryption-key", "", "Encrypt files before they are uploaded, with a data key for each file that is wrapped by this 256 bit master key. In the same format as -sse-c-key. Downloads with the same key are decrypted.")
+	clientKMSKeyID := flag.String("client-encryption-kms-key-id", "", "Encrypt files before they are uploaded, with a data key for each file from this KMS key. Downloads with the same key are decrypted.")
+	sourceProfile := flag.String("source-profile", "", "Use a specific profile from your credential file for the source bucket when syncing between buckets. Defaults to -profile.")
+	deleteRemoved := flag.Bool("delete", false, "Files that exist in the destination but not in the source are deleted during sync.")
+	concurrency := flag.Int("concurrency", 5, "The number of files that are transferred at the same time.")
+	partConcurrency := flag.Int("part-concurrency", s3manager.DefaultUploadConcurrency, "The number of parts of a file that are transferred at the same time.")
+	partSize := ByteSize(s3manager.DefaultUploadPartSize)
+	flag.Var(&partSize, "part-size", "The size of each part in multipart transfers, example 16MB. Must be between 5MB and 5GB.")
+	multipartThreshold := ByteSize(s3manager.DefaultUploadPartSize)
+	flag.Var(&multipartThreshold, "multipart-threshold", "Files of this size or larger are uploaded as multipart uploads, example 64MB. Defaults to -part-size, can't be smaller and can't be larger than 5GB, files smaller than one part are always uploaded in one request.")
+	maxAttempts := flag.Int("max-attempts", 3, "The number of times a file transfer is attempted before giving up. Only temporary errors like throttling, timeouts and server errors are retried.")
+	retryDelay := flag.Duration("retry-delay", time.Second, "The longest wait before the first retry of a failed transfer, it's doubled for each retry and the actual wait is random up to that.")
+	retryMaxDelay := flag.Duration("retry-max-delay", 30*time.Second, "The longest wait between retries of a failed transfer.")
+	filter := &Filter{}
+	journalFile := flag.String("journal", "", "Write the planned and completed transfers to this file, so that an interrupted sync can be continued with -resume. The file is removed when the sync succeeds.")
+	resume := flag.Bool("resume", false, "Continue the interrupted sync in the -journal file, without listing and comparing the files again. Multipart uploads continue with the parts that are missing.")
+	flag.Var(&filterFlag{filter: filter}, "exclude", "Exclude all files or objects from the command that matches the specified pattern, supports '*', '**', '?', '[a-z]', '{a,b}' and '\\' escapes. Can be combined with -include, the last pattern that matches decides.")
+	mimeTypesFile := flag.String("mime-types", "", "Read content types by file extension from this mime.types file, they take precedence over the built in types.")
+	rules := &ObjectRules{}
+	flag.Var(&ruleFlag{rules: rules, set: func(r *ObjectRule, v string) { r.ContentType = v }}, "content-type-rule", "Set the Content-Type of files that matches a pattern, example '*.rss=application/rss+xml'. Overrides the type from the file extension.")
+	flag.Var(&ruleFlag{rules: rules, set: func(r *ObjectRule, v string) { r.CacheControl = v }}, "cache-control-rule", "Set the Cache-Control header of files that matches a pattern, example '*.html=no-cache'.")
+	flag.Var(&ruleFlag{rules: rules, set: func(r *ObjectRule, v string) { r.ContentDisposition = v }}, "content-disposition-rule", "Set the Content-Disposition header of files that matches a pattern, example 'downloads/*=attachment'.")
+	flag.Var(&ruleFlag{rules: rules, set: func(r *ObjectRule, v string) { r.ContentLanguage = v }}, "content-language-rule", "Set the Content-Language header of files that matches a pattern, example 'de/*=de-DE'.")
+	flag.Var(&ruleFlag{rules: rules, set: func(r *ObjectRule, v string) { r.Expires = v }}, "expires-rule", "Set the Expires header of files that matches a pattern, to a date or a duration from the upload, example '*.pdf=720h'.")
+	flag.Var(&ruleFlag{rules: rules, set: func(r *ObjectRule, v string) { r.Compress = v }, implicit: compressGzip}, "compress", "Compress files that matches a pattern with gzip when they are uploaded and set their Content-Encoding, example '*.css' or '*.css=gzip'. Objects compressed by s3sync are decompressed when they are downloaded.")
+	flag.Var(&ruleFlag{rules: rules, set: func(r *ObjectRule, v string) { r.ACL = v }}, "acl-rule", "Set the canned ACL of files that matches a pattern, example 'public/**=public-read'. Overrides -acl.")
+	flag.Var(&ruleFlag{rules: rules, set: func(r *ObjectRule, v string) { r.StorageClass = v }}, "storage-class-rule", "Set the storage class of files that matches a pattern, example 'archive/**=STANDARD_IA'. Overrides -storage-class.")
+	flag.Var(&ruleFlag{rules: rules, set: func(r *ObjectRule, v string) {
+		key, value := splitTag(v)
+		r.Tags = map[string]string{key: value}
+	}}, "tag-rule", "Tag files that matches a pattern, example 'logs/**=retention=90d'. The tags are added to the -tag tags.")
+	var tags StringSlice
+	flag.Var(&tags, "tag", "Tag uploaded objects with KEY=VALUE, example -tag team=web -tag env=prod.")
+	preserve := flag.String("preserve", "", "Store attributes of uploaded files in the object metadata and restore them when downloading, a comma separated list of mode, ownership, xattrs or all.")
+	var xattrs StringSlice
+	flag.Var(&xattrs, "xattrs", "The extended attributes that are preserved with -preserve xattrs, supports '*'. Defaults to 'user.*'.")
+	numericIDs := flag.Bool("numeric-ids", false, "Store and restore only the uid and gid with -preserve ownership, instead of mapping them by user and group name.")
+	symlinks := flag.String("symlinks", "", "How symbolic links in the local directory are synced: follow uploads what they point to, skip leaves them out and metadata uploads them as empty objects with the target in their metadata, so that downloads can recreate them. Defaults to follow.")
+	followSymlinks := flag.Bool("follow-symlinks", false, "Upload the files and directories that symbolic links point to, the same as -symlinks follow.")
+	noFollowSymlinks := flag.Bool("no-follow-symlinks", false, "Don't upload symbolic links, the same as -symlinks skip.")
+	acl := flag.String("acl", "", "The canned ACL of uploaded and copied objects, example public-read or bucket-owner-full-control.")
+	storageClass := flag.String("storage-class", "", "The storage class of uploaded and copied objects, example STANDARD_IA or INTELLIGENT_TIERING.")
+	flag.Var(&rulesFileFlag{rules}, "rules", "Read rules for the headers of uploaded files from this JSON file, example [{\"pattern\": \"*.html\", \"cache_control\": \"no-cache\"}]. The rules are applied in the same order as the -*-rule flags.")
+	gitignore := flag.Bool("gitignore", false, "Also ignore files that are ignored by .gitignore files, in the same way as .s3syncignore files.")
+	var excludeFrom StringSlice
+	flag.Var(&excludeFrom, "exclude-from", "Exclude files that matches the patterns in this file, it uses the same syntax as .gitignore files.")
+	strictGlobs := flag.Bool("strict-globs", false, "'*', '?' and character classes in -include and -exclude patterns doesn't match '/', use '**' to match across directories.")
+	matchBasename := flag.Bool("match-basename", false, "-include and -exclude patterns without a '/' are matched against the file or directory name at any depth, instead of the whole path. Patterns that starts with '/' are always matched against the whole path.")
+	flag.Var(&filterFlag{filter: filter, include: true}, "include", "Don't exclude files or objects that matches the specified pattern, for example -exclude '*' -include '*.css'. The patterns are applied in the order they are given, the last pattern that matches decides.")
 
 	flag.Parse()
 
-	logger := NewLogger(*debug, *onlyShowErrors)
+	if *output != "text" && *output != "json" {
+		flag.Usage()
+		fmt.Fprintf(os.Stderr, "\n-output must be 'text' or 'json', not '%s'\n", *output)
+		os.Exit(exitConfigError)
+	}
+	logger := NewLogger(*debug, *onlyShowErrors, *output == "json")
 
-	localPath, err := filepath.Abs(flag.Arg(0))
+	if int64(partSize) < s3manager.MinUploadPartSize || int64(partSize) > maxPartSize {
+		flag.Usage()
+		logger.Err.Printf("\n-part-size must be between %d and %d bytes\n", s3manager.MinUploadPartSize, maxPartSize)
+		os.Exit(exitConfigError)
+	}
+	thresholdSet := false
+	flag.Visit(func(f *flag.Flag) {
+		thresholdSet = thresholdSet || f.Name == "multipart-threshold"
+	})
+	if !thresholdSet {
+		multipartThreshold = partSize
+	} else if multipartThreshold < partSize {
+		flag.Usage()
+		logger.Err.Printf("\n-multipart-threshold can't be smaller than -part-size, files smaller than one part are uploaded in one request\n")
+		os.Exit(exitConfigError)
+	} else if int64(multipartThreshold) > maxPartSize {
+		flag.Usage()
+		logger.Err.Printf("\n-multipart-threshold can't be larger than %d bytes, the largest file that can be uploaded in one request\n", maxPartSize)
+		os.Exit(exitConfigError)
+	}
+	globOpts := globOptions{Slash: *strictGlobs, Basename: *matchBasename}
+	if err := filter.compile(globOpts); err != nil {
+		flag.Usage()
+		logger.Err.Printf("\n%s\n", err)
+		os.Exit(exitConfigError)
+	}
+	if *acl != "" || *storageClass != "" || len(tags) > 0 {
+		// the flags apply to all files, but the rules for patterns override them
+		rule := &ObjectRule{Pattern: "**", ACL: *acl, StorageClass: *storageClass}
+		for _, tag := range tags {
+			if rule.Tags == nil {
+				rule.Tags = make(map[string]string)
+			}
+			key, value := splitTag(tag)
+			rule.Tags[key] = value
+		}
+		if err := rule.validate(); err != nil {
+			flag.Usage()
+			logger.Err.Printf("\n%s\n", err)
+			os.Exit(exitConfigError)
+		}
+		rules.addDefault(rule)
+	}
+	if err := rules.compile(globOpts); err != nil {
+		flag.Usage()
+		logger.Err.Printf("\n%s\n", err)
+		os.Exit(exitConfigError)
+	}
+	if *resume && *journalFile == "" {
+		flag.Usage()
+		logger.Err.Println("\n-resume requires -journal")
+		os.Exit(exitConfigError)
+	}
+	if *concurrency < 1 || *partConcurrency < 1 || *maxAttempts < 1 {
+		flag.Usage()
+		logger.Err.Println("\n-concurrency, -part-concurrency and -max-attempts must be at least 1")
+		os.Exit(exitConfigError)
+	}
+	encryption, err := newEncryption(*sse, *sseKMSKeyID, *sseC, *sseCKey)
+	if err != nil {
+		flag.Usage()
+		logger.Err.Printf("\n%s\n", err)
+		os.Exit(exitConfigError)
+	}
+	sourceEncryption, err := newEncryption("", "", *sourceSSECKey != "", *sourceSSECKey)
 	if err != nil {
 		flag.Usage()
-		logger.Err.Printf("\nCould not parse LocalPath '%s': %s\n", flag.Arg(0), err)
-		os.Exit(1)
+		logger.Err.Printf("\n-source-sse-c-key: %s\n", err)
+		os.Exit(exitConfigError)
+	}
+	var clientEncryption KeyWrapper
+	// the KMS client needs the session, it's set when the session has been created
+	var kmsWrapper *kmsKeyWrapper
+	if *clientKMSKeyID != "" {
+		kmsWrapper = &kmsKeyWrapper{keyID: *clientKMSKeyID}
+		clientEncryption = kmsWrapper
+	}
+	if *clientKey != "" {
+		if *clientKMSKeyID != "" {
+			flag.Usage()
+			logger.Err.Println("\n-client-encryption-key and -client-encryption-kms-key-id can't be used together")
+			os.Exit(exitConfigError)
+		}
+		key, err := parseCustomerKey(*clientKey)
+		if err == nil {
+			clientEncryption, err = newLocalKeyWrapper([]byte(key))
+		}
+		if err != nil {
+			flag.Usage()
+			logger.Err.Printf("\n-client-encryption-key: %s\n", err)
+			os.Exit(exitConfigError)
+		}
+	}
+	if (*clientKey != "" || *clientKMSKeyID != "") && rules.compresses() {
+		flag.Usage()
+		logger.Err.Println("\n-compress can't be used with client side encryption, Content-Encoding would describe the encrypted data")
+		os.Exit(exitConfigError)
 	}
 
-	s3URL, err := url.Parse(flag.Arg(1))
+	preserveAttributes, err := parsePreserve(*preserve, xattrs, *numericIDs)
 	if err != nil {
 		flag.Usage()
-		logger.Err.Printf("\nCould not parse S3Uri '%s'\n", flag.Arg(1))
-		os.Exit(1)
+		logger.Err.Printf("\n-preserve: %s\n", err)
+		os.Exit(exitConfigError)
 	}
-	if s3URL.Scheme != "s3" {
+
+	symlinkPolicy, err := parseSymlinkPolicy(*symlinks, *followSymlinks, *noFollowSymlinks)
+	if err != nil {
 		flag.Usage()
-		logger.Err.Println("\nS3Uri argument does not have valid protocol, should be 's3'")
-		os.Exit(1)
+		logger.Err.Printf("\n%s\n", err)
+		os.Exit(exitConfigError)
 	}
-	if s3URL.Host == "" {
+
+	strategy, err := newSyncStrategy(strategyOptions{
+		SizeOnly:        *sizeOnly,
+		ExactTimestamps: *exactTimestamps,
+		Checksum:        *checksum,
+		IgnoreExisting:  *ignoreExisting,
+		Existing:        *existing,
+		PartSize:        int64(partSize),
+		OpaqueETags:     encryption.opaqueETags() || sourceEncryption.opaqueETags(),
+		Keys:            clientEncryption,
+	})
+	if err != nil {
 		flag.Usage()
-		logger.Err.Println("\nS3Uri is missing bucket name")
-		os.Exit(1)
+		logger.Err.Printf("\n%s\n", err)
+		os.Exit(exitConfigError)
+	}
+
+	config := &Config{
+		DryRun:             *dryrun,
+		Strategy:           strategy,
+		Filter:             filter,
+		MimeTypes:          newMimeTypes(),
+		Rules:              rules,
+		Encryption:         encryption,
+		ClientEncryption:   clientEncryption,
+		Preserve:           preserveAttributes,
+		Symlinks:           symlinkPolicy,
+		Concurrency:        *concurrency,
+		PartSize:           int64(partSize),
+		PartConcurrency:    *partConcurrency,
+		MultipartThreshold: int64(multipartThreshold),
+		Summary:            NewSummary(),
+		Retry: &RetryPolicy{
+			MaxAttempts: *maxAttempts,
+			BaseDelay:   *retryDelay,
+			MaxDelay:    *retryMaxDelay,
+		},
+	}
+
+	if *progress {
+		config.Progress = NewProgress(os.Stdout, *output == "json")
+		logger.wrapOutput(config.Progress.Writer)
+	}
+
+	if *cacheFile != "" {
+		config.Cache = loadStateCache(*cacheFile, *rebuildCache, logger)
+	}
+
+	if *mimeTypesFile != "" {
+		if err := config.MimeTypes.load(*mimeTypesFile); err != nil {
+			flag.Usage()
+			logger.Err.Printf("\nCould not read -mime-types file: %v\n", err)
+			os.Exit(exitConfigError)
+		}
+	}
+
+	// a missing local path would resolve to the current directory, which -delete could empty
+	if flag.NArg() != 2 {
+		flag.Usage()
+		logger.Err.Printf("\nExpected a source and a destination, got %d arguments\n", flag.NArg())
+		os.Exit(exitConfigError)
+	}
+
+	var s3Arg string
+	switch {
+	case isS3Uri(flag.Arg(0)) && isS3Uri(flag.Arg(1)):
+		config.Mode = Copy
+		s3Arg = flag.Arg(1)
+	case isS3Uri(flag.Arg(0)):
+		config.Mode = Download
+		s3Arg = flag.Arg(0)
+		config.LocalPath = flag.Arg(1)
+	default:
+		config.Mode = Upload
+		s3Arg = flag.Arg(1)
+		config.LocalPath = flag.Arg(0)
+	}
+
+	if config.Mode != Copy {
+		if strings.TrimSpace(config.LocalPath) == "" {
+			flag.Usage()
+			logger.Err.Printf("\nThe local path can't be empty\n")
+			os.Exit(exitConfigError)
+		}
+		localPath, err := filepath.Abs(config.LocalPath)
+		if err != nil {
+			flag.Usage()
+			logger.Err.Printf("\nCould not parse LocalPath '%s': %s\n", config.LocalPath, err)
+			os.Exit(exitConfigError)
+		}
+		config.LocalPath = localPath
+	}
+
+	// .s3syncignore files are read from the local directory, so in copy mode only -exclude-from files are used
+	ignoreNames := []string{s3syncIgnoreFile}
+	if *gitignore {
+		ignoreNames = append(ignoreNames, ".gitignore")
+	}
+	filter.ignores = newIgnoreFiles(config.LocalPath, ignoreNames, logger)
+	for _, path := range excludeFrom {
+		if err := filter.ignores.addExcludeFrom(path); err != nil {
+			flag.Usage()
+			logger.Err.Printf("\nCould not read -exclude-from file: %v\n", err)
+			os.Exit(exitConfigError)
+		}
+	}
+
+	config.Bucket, config.BucketPrefix, err = parseS3Uri(s3Arg)
+	if err != nil {
+		flag.Usage()
+		logger.Err.Printf("\n%s\n", err)
+		os.Exit(exitConfigError)
 	}
 
 	sess, err := getSession(*profile, *region, logger)
 	if err != nil {
 		logger.Err.Printf("%v\n", err)
+		os.Exit(exitConfigError)
 	}
-
-	config := &Config{
-		S3Service:    s3.New(sess),
-		Bucket:       s3URL.Host,
-		BucketPrefix: strings.TrimPrefix(s3URL.Path, "/"),
-		DryRun:       *dryrun,
+	config.S3Service = s3.New(sess)
+	if kmsWrapper != nil {
+		kmsWrapper.kms = kms.New(sess)
 	}
 
-	// load all local files that doesn't match exclude
-	local := loadLocalFiles(localPath, exclude, logger)
+	if config.Mode == Copy {
+		config.Source = &Config{Filter: filter, Encryption: sourceEncryption}
+		config.Source.Bucket, config.Source.BucketPrefix, err = parseS3Uri(flag.Arg(0))
+		if err != nil {
+			flag.Usage()
+			logger.Err.Printf("\n%s\n", err)
+			os.Exit(exitConfigError)
+		}
+		if *sourceProfile == "" {
+			*sourceProfile = *profile
+		}
+		if *sourceRegion == "" {
+			*sourceRegion = *region
+		}
+		sourceSess, err := getSession(*sourceProfile, *sourceRegion, logger)
+		if err != nil {
+			logger.Err.Printf("%v\n", err)
+			os.Exit(exitConfigError)
+		}
+		config.Source.S3Service = s3.New(sourceSess)
+	}
 
-	// we keep 50,000 (50 s3:listObjects calls) to be in the output remote channel,
-	// this will ensure that we can find all local files without blocking the AWS calls
-	remote := loadS3Files(config, 50000, logger)
+	if *journalFile != "" {
+		if *resume {
+			config.Journal, err = resumeJournal(*journalFile, config)
+		} else if !config.DryRun {
+			config.Journal, err = newJournal(*journalFile, config)
+		}
+		if err != nil {
+			logger.Err.Printf("Could not open journal: %v\n", err)
+			os.Exit(exitConfigError)
+		}
+	}
 
-	// find out which files that needs syncing
-	files := compare(local, remote, logger)
+	var files chan *FileStat
+	var extraneous chan []*FileStat
+	if config.Journal.completeListing() {
+		// everything that needs syncing is in the journal, so there's no need to list and compare again
+		logger.Debug.Printf("resuming from %s\n", *journalFile)
+		files = config.Journal.pending(config)
+		if *deleteRemoved {
+			logger.Err.Println("-delete is ignored when resuming, run the sync again without -resume to delete files")
+			*deleteRemoved = false
+		}
+	} else {
+		files, extraneous = findFiles(config, logger)
+	}
 
-	// sync all files to s3
+	// sync all files to or from s3
+	config.Progress.Start(logger)
 	syncFiles(config, files, logger)
+	config.Progress.Stop()
+
+	// deleting only happens after all files have been synced
+	if *deleteRemoved {
+		deleteFiles(config, <-extraneous, logger)
+	}
+
+	// the cache is only updated after a successful run, so a failed run can be retried with the old cache
+	if !config.DryRun && config.Summary.success() {
+		if err := config.Cache.save(); err != nil {
+			logger.Err.Printf("Could not save cache: %v\n", err)
+		}
+	}
+
+	// the journal is kept after a failed run so that it can be resumed
+	if err := config.Journal.close(!config.DryRun && config.Summary.success()); err != nil {
+		logger.Err.Printf("Could not write journal: %v\n", err)
+	}
+
+	printSummary(config, logger)
+	os.Exit(config.Summary.exitCode())
 }
 
-// compare will put a local file on the output channel if:
-// - the size of the local file is different than the size of the s3 object
-// - the last modified time of the local file is newer than the last modified time of the s3 object
-// - the local file does not exist under the specified bucket and prefix.
-// This is the same logic as the aws s3 sync tool uses, see https://github.com/aws/aws-cli/blob/e2295b022db35eea9fec7e6c5540d06dbd6e588b/awscli/customizations/s3/syncstrategy/base.py#L226
-func compare(foundLocal, foundRemote chan *FileStat, logger *Logger) chan *FileStat {
+// findFiles lists the source and destination for the config.Mode and returns the files that needs syncing and the
+// files that only exist in the destination
+func findFiles(config *Config, logger *Logger) (files chan *FileStat, extraneous chan []*FileStat) {
+	switch config.Mode {
+	case Copy:
+		source := loadS3Files(config.Source, 50000, logger)
+		dest := loadS3Files(config, 50000, logger)
+		files, extraneous = compare(config, source, dest, logger)
+	case Download:
+		// the target directory might not exist yet, in that case everything in the bucket should be downloaded
+		local := noFiles()
+		if _, err := os.Stat(config.LocalPath); err == nil {
+			local = loadLocalFiles(config.LocalPath, config.Filter, config.Symlinks, config.Cache, logger)
+		}
+		remote := loadS3Files(config, 50000, logger)
+		// objects that are compressed or encrypted by s3sync needs their metadata to be compared and restored
+		remote = headObjects(config, remote, needsHead(config), logger)
+		files, extraneous = compare(config, remote, local, logger)
+	default:
+		// load all local files that are included by the filter
+		local := loadLocalFiles(config.LocalPath, config.Filter, config.Symlinks, config.Cache, logger)
+
+		// we keep 50,000 (50 s3:listObjects calls) to be in the output remote channel,
+		// this will ensure that we can find all local files without blocking the AWS calls
+		remote := loadS3Files(config, 50000, logger)
+		// objects that should be compressed or encrypted needs their metadata to be compared with the local files
+		remote = headObjects(config, remote, needsHead(config), logger)
+
+		// find out which files that needs syncing
+		files, extraneous = compare(config, local, remote, logger)
+	}
+	return files, extraneous
+}
 
-	update := make(chan *FileStat, 8)
+// printSummary prints the numbers of files that were synced, skipped and failed
+func printSummary(config *Config, logger *Logger) {
+	verb := "uploaded"
+	switch config.Mode {
+	case Download:
+		verb = "downloaded"
+	case Copy:
+		verb = "copied"
+	}
+	logger.Event(config.Summary.event(verb, config.DryRun))
+}
+
+// isS3Uri returns true if the argument looks like a s3://bucket/prefix uri
+func isS3Uri(arg string) bool {
+	return strings.HasPrefix(arg, "s3://")
+}
+
+// parseS3Uri splits a s3://bucket/prefix uri into the bucket name and the prefix
+func parseS3Uri(uri string) (bucket, prefix string, err error) {
+	s3URL, err := url.Parse(uri)
+	if err != nil {
+		return "", "", fmt.Errorf("could not parse S3Uri '%s'", uri)
+	}
+	if s3URL.Scheme != "s3" {
+		return "", "", errors.New("S3Uri argument does not have valid protocol, should be 's3'")
+	}
+	if s3URL.Host == "" {
+		return "", "", errors.New("S3Uri is missing bucket name")
+	}
+	return s3URL.Host, strings.Trim(s3URL.Path, "/"), nil
+}
+
+// objectKey returns the s3 object key for a file name under the prefix
+func objectKey(prefix, name string) string {
+	return strings.TrimPrefix(path.Join(prefix, name), "/")
+}
+
+// noFiles returns an already closed channel, useful when one side of a sync is known to be empty
+func noFiles() chan *FileStat {
+	out := make(chan *FileStat)
+	close(out)
+	return out
+}
+
+// compare will put a source file on the output channel if the config.Strategy decides that it should be synced, see
+// defaultStrategy for the rules that are used when no other strategy has been chosen.
+// When uploading the source is the local files and the destination is the s3 objects, when downloading it's the other
+// way around. Files of the same size that would be synced because of their modified times are compared again with the
+// modified time in the metadata of the s3 object, which is the time of the original file and not of the upload.
+// Files that only exists in the destination are sent as one slice on the second channel after all the files to sync
+// has been sent. If any source or destination file couldn't be read, that slice is empty.
+func compare(config *Config, foundSource, foundDest chan *FileStat, logger *Logger) (chan *FileStat, chan []*FileStat) {
+
+	strategy := config.Strategy
+	if strategy == nil {
+		strategy = defaultStrategy{}
+	}
 
-	// first we sink the local files into a lookup map so its quick and easy to compare that to the remote
-	localFiles := make(map[string]*FileStat)
-	for r := range foundLocal {
+	update := make(chan *FileStat, 8)
+	extraneous := make(chan []*FileStat, 1)
+
+	// first we sink the source files into a lookup map so its quick and easy to compare that to the destination
+	sourceFiles := make(map[string]*FileStat)
+	// complete is false if not all source or destination files could be read, and we can't know which files that are
+	// only in the destination
+	complete := true
+	for r := range foundSource {
 		if r.Err != nil {
-			logger.Err.Println(r.Err)
+			logger.Event(&Event{Type: EventError, Error: r.Err.Error()})
+			config.Summary.listingError()
+			complete = false
 			continue
 		}
-		localFiles[r.Name] = r
+		sourceFiles[r.Name] = r
 	}
 
-	numLocalFiles := len(localFiles)
-	numRemoteFiles := 0
+	numSourceFiles := len(sourceFiles)
+	numDestFiles := 0
 
 	go func() {
 		defer close(update)
+		defer config.Progress.listed()
+
+		report := func(source *FileStat, needed bool, reason string) {
+			if needed {
+				logger.Debug.Printf("syncing: %s, %s\n", source.Name, reason)
+				config.Progress.queued(source)
+				update <- source
+			} else {
+				logger.Event(&Event{Type: EventSkip, Name: source.Name, Size: source.Size, Reason: reason})
+				config.Summary.skip()
+			}
+		}
 
-		for remote := range foundRemote {
-			if remote.Err != nil {
-				logger.Err.Printf("Remote %s\n", remote.Err)
+		var destOnly []*FileStat
+		defer func() {
+			if !complete {
+				logger.Debug.Println("not all files could be read, skipping files only in the destination")
+				destOnly = nil
+			}
+			extraneous <- destOnly
+			close(extraneous)
+		}()
+
+		// files that would be synced because they are newer are checked against the modified time in the metadata of the
+		// remote file first, and downloads against the size of the original file of compressed or encrypted objects. The
+		// HeadObject calls are made concurrently while the comparison continues.
+		recheck := make(chan [2]*FileStat, headConcurrency)
+		var wg sync.WaitGroup
+		for i := 0; i < headConcurrency; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for pair := range recheck {
+					remote := remoteFile(pair[0], pair[1])
+					if err := headObject(config, remote); err != nil {
+						logger.Err.Printf("Could not get the metadata of s3://%s/%s: %v\n", config.Bucket, remote.Path, err)
+					}
+					needed, reason := shouldSync(config, strategy, pair[0], pair[1])
+					report(pair[0], needed, reason)
+				}
+			}()
+		}
+		defer func() {
+			close(recheck)
+			wg.Wait()
+		}()
+
+		for dest := range foundDest {
+			if dest.Err != nil {
+				logger.Event(&Event{Type: EventError, Error: fmt.Sprintf("Destination %s", dest.Err)})
+				config.Summary.listingError()
+				complete = false
 				return
 			}
-			numRemoteFiles++
-			if local, ok := localFiles[remote.Name]; ok {
-				if local.Size != remote.Size {
-					logger.Debug.Printf("syncing: %s, size %d -> %d\n", local.Name, local.Size, remote.Size)
-					update <- local
-				} else if local.ModTime.After(remote.ModTime) {
-					logger.Debug.Printf("syncing: %s, modified time: %s -> %s\n", local.Name, local.ModTime, remote.ModTime.In(local.ModTime.Location()))
-					update <- local
+			numDestFiles++
+			if source, ok := sourceFiles[dest.Name]; ok {
+				needed, reason := shouldSync(config, strategy, source, dest)
+				if needed && needsMetadata(config, strategy, source, dest) {
+					recheck <- [2]*FileStat{source, dest}
+				} else {
+					report(source, needed, reason)
 				}
-				delete(localFiles, remote.Name)
+				delete(sourceFiles, dest.Name)
+			} else {
+				destOnly = append(destOnly, dest)
 			}
 		}
 
-		for _, local := range localFiles {
-			logger.Debug.Printf("syncing: %s, file does not exist at destination\n", local.Name)
-			update <- local
+		for _, source := range sourceFiles {
+			needed, reason := strategy.ShouldSync(source, nil)
+			report(source, needed, reason)
 		}
-		logger.Debug.Printf("Found %d local files\n", numLocalFiles)
-		logger.Debug.Printf("Found %d remote files\n", numRemoteFiles)
+		logger.Debug.Printf("Found %d source files\n", numSourceFiles)
+		logger.Debug.Printf("Found %d destination files\n", numDestFiles)
 	}()
 
-	return update
+	return update, extraneous
+}
+
+// shouldSync asks the strategy if the source should be synced to the destination, unless the destination object has
+// been fetched with HeadObject and isn't compressed or encrypted the way it should be. Links are uploaded as empty
+// objects that are never compressed or encrypted, so objects that are links, or haven't been fetched, are only
+// compared by the strategy.
+func shouldSync(config *Config, strategy SyncStrategy, source, dest *FileStat) (bool, string) {
+	if config.Mode == Upload && source.LinkTarget != "" && (dest.Metadata == nil || symlinkTarget(dest) != "") {
+		return strategy.ShouldSync(source, dest)
+	}
+	if config.ClientEncryption != nil {
+		var encrypted bool
+		if source, dest, encrypted = withPlaintextSize(source, dest); !encrypted && config.Mode == Upload {
+			return true, "object isn't encrypted"
+		}
+	}
+	if config.Mode == Upload && dest.Metadata != nil {
+		if config.ClientEncryption != nil && !encryptedBySync(dest) {
+			return true, "object isn't encrypted"
+		}
+		if compress := config.Rules.match(source.Name).Compress; compress != dest.ContentEncoding {
+			return true, fmt.Sprintf("content encoding is '%s', should be '%s'", dest.ContentEncoding, compress)
+		}
+	}
+	return strategy.ShouldSync(source, dest)
 }
 
-// syncFiles takes a channel of *FileStat and tries to upload them to s3
+// syncFiles takes a channel of *FileStat and tries to upload them to s3, download them from s3 or copy them between
+// buckets depending on the config.Mode
 func syncFiles(config *Config, in chan *FileStat, logger *Logger) {
 
-	concurrency := 5
+	var transfer func(*Config, *FileStat, *Logger) error
+	switch config.Mode {
+	case Download:
+		transfer = download
+	case Copy:
+		transfer = copyObject
+	default:
+		transfer = upload
+	}
+
+	concurrency := config.Concurrency
+	if concurrency < 1 {
+		concurrency = 5
+	}
 	sem := make(chan bool, concurrency)
-	var numSyncedFiles int
 
 	for file := range in {
+		if !config.DryRun {
+			config.Journal.plan(file)
+		}
 		// add one
 		sem <- true
 		go func(config *Config, file *FileStat, logger *Logger) {
-			err := upload(config, file, logger)
-			if err != nil {
-				logger.Err.Println(err)
-			} else {
-				numSyncedFiles++
+			start := time.Now()
+			attempts, err := config.Retry.do(func() error {
+				attemptConfig := *config
+				attemptConfig.Progress = config.Progress.attempt()
+				err := transfer(&attemptConfig, file, logger)
+				if err != nil {
+					attemptConfig.Progress.undo()
+				}
+				return err
+			}, func(attempt int, err error, wait time.Duration) {
+				logger.Debug.Printf("retrying %s in %s, attempt %d failed: %v\n", file.Name, wait.Round(time.Millisecond), attempt, err)
+			})
+			if err == nil && !config.DryRun {
+				config.Journal.complete(file)
 			}
+			result := &Result{File: file, Err: err, Duration: time.Since(start), Attempts: attempts}
+			config.Summary.add(result)
+			config.Progress.fileDone()
+			logger.Event(resultEvent(config, result))
 			// remove one
 			<-sem
 		}(config, file, logger)
 	}
 
+	// every file that needs syncing has been planned, so a resumed sync doesn't have to list the files again
+	if !config.DryRun {
+		config.Journal.markListed()
+	}
+
 	// After the last goroutine is fired, there are still concurrency amount of goroutines running. In order to make
 	// sure we wait for all of them to finish, we attempt to fill the semaphore back up to its capacity. Once that
 	// succeeds, we know that the last goroutine has read from the semaphore, as we've done len(files) + cap(sem) writes
@@ -162,12 +695,14 @@ func syncFiles(config *Config, in chan *FileStat, logger *Logger) {
 	for i := 0; i < cap(sem); i++ {
 		sem <- true
 	}
-
-	logger.Debug.Printf("Synced %d local files to remote\n", numSyncedFiles)
 }
 
 func upload(config *Config, fileStat *FileStat, logger *Logger) error {
 
+	if fileStat.LinkTarget != "" {
+		return uploadSymlink(config, fileStat, logger)
+	}
+
 	logger.Debug.Printf("will upload %s to s3://%s/%s\n", fileStat.Path, config.Bucket, config.BucketPrefix)
 
 	file, err := os.Open(fileStat.Path)
@@ -180,43 +715,131 @@ func upload(config *Config, fileStat *FileStat, logger *Logger) error {
 		}
 	}()
 
-	contentType := "application/octet-stream"
-	// Don't try to detect content types on empty files
-	if fileStat.Size != 0 {
-		// detect the ContentType in the first 512 bytes of the file
-		magicBytes := make([]byte, 512)
-		if _, err := file.Read(magicBytes); err != nil {
+	props := config.Rules.match(fileStat.Name)
+	contentType := props.ContentType
+	if contentType == "" {
+		if contentType, err = config.MimeTypes.contentType(fileStat.Name, file, fileStat.Size); err != nil {
 			return err
 		}
-		if _, err := file.Seek(0, 0); err != nil {
-			return err
-		}
-		contentType = http.DetectContentType(magicBytes)
 	}
 
-	key := filepath.Join(config.BucketPrefix, fileStat.Name)
-	key = strings.TrimPrefix(key, "/")
-	s3Uri := filepath.Join(config.Bucket, key)
+	key := objectKey(config.BucketPrefix, fileStat.Name)
 
 	if config.DryRun {
-		logger.Out.Printf("(dryrun) upload: %s to s3://%s\n", fileStat.Name, s3Uri)
 		return nil
 	}
 
-	// Create an uploader (can do multipart) with S3 client and default options
-	uploader := s3manager.NewUploaderWithClient(config.S3Service)
+	// content is what's uploaded, the file or a compressed copy of it
+	content, size := file, fileStat.Size
+	var metadata map[string]*string
+	if props.Compress != "" {
+		compressed, originalSize, sum, err := compressFile(fileStat.Path)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = compressed.Close()
+			_ = os.Remove(compressed.Name())
+		}()
+		stat, err := compressed.Stat()
+		if err != nil {
+			return err
+		}
+		content, size = compressed, stat.Size()
+		// the metadata lets the next sync compare the object with the original file
+		metadata = map[string]*string{
+			metaUncompressedSize: aws.String(strconv.FormatInt(originalSize, 10)),
+			metaUncompressedMD5:  aws.String(sum),
+		}
+		// the progress counts the original size, the part that compression saved is done already
+		config.Progress.transferred(fileStat.Size - size)
+	}
+	if config.ClientEncryption != nil {
+		encrypted, encryptionMetadata, err := encryptFile(content, config.ClientEncryption)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = encrypted.Close()
+			_ = os.Remove(encrypted.Name())
+		}()
+		stat, err := encrypted.Stat()
+		if err != nil {
+			return err
+		}
+		// the progress counts the original size, the tags of the chunks are counted off in advance
+		config.Progress.transferred(size - stat.Size())
+		content, size, metadata = encrypted, stat.Size(), encryptionMetadata
+	}
+	if metadata == nil {
+		metadata = make(map[string]*string)
+	}
+	metadata[metaMtime] = aws.String(formatMtime(fileStat.ModTime))
+	if config.Preserve != nil {
+		stat, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		attributes, err := config.Preserve.metadata(fileStat.Path, stat)
+		if err != nil {
+			return err
+		}
+		for key, value := range attributes {
+			metadata[key] = value
+		}
+		if dropLargeXattrs(metadata) {
+			logger.Err.Printf("not preserving the extended attributes of %s, they don't fit in the %d bytes of object metadata\n", fileStat.Name, maxMetadataSize)
+		}
+	}
+
+	// Create an uploader (can do multipart) with S3 client and the configured part size and concurrency
+	uploader := s3manager.NewUploaderWithClient(config.S3Service, func(u *s3manager.Uploader) {
+		if config.PartSize > 0 {
+			u.PartSize = config.PartSize
+		}
+		if config.PartConcurrency > 0 {
+			u.Concurrency = config.PartConcurrency
+		}
+		// s3manager only does a multipart upload when the file is larger than one part, so files below the threshold
+		// are uploaded with one PutObject by making the part large enough
+		if size < config.MultipartThreshold && u.PartSize < config.MultipartThreshold {
+			u.PartSize = config.MultipartThreshold
+		}
+	})
+	var body io.Reader = content
+	if config.Progress != nil {
+		body = &progressReader{file: content, progress: config.Progress}
+	}
+
 	params := &s3manager.UploadInput{
 		Bucket:      aws.String(config.Bucket),
 		Key:         aws.String(key),
-		Body:        file,
+		Body:        body,
 		ContentType: aws.String(contentType),
+		Metadata:    metadata,
+	}
+	if props.Compress != "" {
+		params.ContentEncoding = aws.String(props.Compress)
+	}
+	setObjectHeaders(params, props, time.Now())
+	config.Encryption.setUpload(params)
+
+	// large files are uploaded part by part when there's a journal, so the upload can be resumed if it's interrupted.
+	// Encrypted files get a new data key for every upload, so their parts can't be reused.
+	if config.Journal != nil && config.ClientEncryption == nil && size >= config.MultipartThreshold && size > config.PartSize {
+		uploadStat := *fileStat
+		uploadStat.Size = size
+		return resumableUpload(config, &uploadStat, content, params)
 	}
 
-	if _, err = uploader.Upload(params); err != nil {
+	out, err := uploader.Upload(params)
+	if err != nil {
 		return err
 	}
+	if out.UploadID != "" {
+		return tagMultipartUpload(config, params)
+	}
 
-	logger.Out.Printf("upload: %s to s3://%s\n", fileStat.Name, s3Uri)
 	return nil
 }
 
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"errors"
 	"testing"
 	"time"
 )
 
 func TestCompare(t *testing.T) {
+	newer := time.Now()
+	older := newer.Add(-time.Minute)
 	tests := []struct {
+		strategy   SyncStrategy
 		local      *FileStat
 		remote     *FileStat
 		shouldSync bool
@@ -46,6 +50,76 @@ func TestCompare(t *testing.T) {
 			remote:     &FileStat{Name: "file.html", Size: 1, ModTime: time.Now().Add(-time.Minute)},
 			shouldSync: true,
 		},
+		// size only
+		{
+			strategy:   sizeOnlyStrategy{},
+			local:      &FileStat{Name: "file.html", Size: 1, ModTime: newer},
+			remote:     &FileStat{Name: "file.html", Size: 1, ModTime: older},
+			shouldSync: false,
+		},
+		{
+			strategy:   sizeOnlyStrategy{},
+			local:      &FileStat{Name: "file.html", Size: 1, ModTime: older},
+			remote:     &FileStat{Name: "file.html", Size: 2, ModTime: newer},
+			shouldSync: true,
+		},
+		{
+			strategy:   sizeOnlyStrategy{},
+			local:      &FileStat{Name: "lol.html", Size: 1},
+			remote:     &FileStat{Name: "file.html", Size: 1},
+			shouldSync: true,
+		},
+		// exact timestamps
+		{
+			strategy:   exactTimestampsStrategy{},
+			local:      &FileStat{Name: "file.html", Size: 1, ModTime: older},
+			remote:     &FileStat{Name: "file.html", Size: 1, ModTime: newer},
+			shouldSync: true,
+		},
+		{
+			strategy:   exactTimestampsStrategy{},
+			local:      &FileStat{Name: "file.html", Size: 1, ModTime: newer},
+			remote:     &FileStat{Name: "file.html", Size: 1, ModTime: older},
+			shouldSync: true,
+		},
+		{
+			strategy:   exactTimestampsStrategy{},
+			local:      &FileStat{Name: "file.html", Size: 1, ModTime: newer.Truncate(time.Second).Add(time.Millisecond)},
+			remote:     &FileStat{Name: "file.html", Size: 1, ModTime: newer.Truncate(time.Second)},
+			shouldSync: false,
+		},
+		// ignore existing
+		{
+			strategy:   ignoreExistingStrategy{},
+			local:      &FileStat{Name: "file.html", Size: 2, ModTime: newer},
+			remote:     &FileStat{Name: "file.html", Size: 1, ModTime: older},
+			shouldSync: false,
+		},
+		{
+			strategy:   ignoreExistingStrategy{},
+			local:      &FileStat{Name: "lol.html", Size: 1},
+			remote:     &FileStat{Name: "file.html", Size: 1},
+			shouldSync: true,
+		},
+		// existing
+		{
+			strategy:   existingStrategy{next: defaultStrategy{}},
+			local:      &FileStat{Name: "lol.html", Size: 1},
+			remote:     &FileStat{Name: "file.html", Size: 1},
+			shouldSync: false,
+		},
+		{
+			strategy:   existingStrategy{next: defaultStrategy{}},
+			local:      &FileStat{Name: "file.html", Size: 1, ModTime: newer},
+			remote:     &FileStat{Name: "file.html", Size: 1, ModTime: older},
+			shouldSync: true,
+		},
+		{
+			strategy:   existingStrategy{next: sizeOnlyStrategy{}},
+			local:      &FileStat{Name: "file.html", Size: 1, ModTime: newer},
+			remote:     &FileStat{Name: "file.html", Size: 1, ModTime: older},
+			shouldSync: false,
+		},
 	}
 
 	for _, test := range tests {
@@ -60,7 +134,7 @@ func TestCompare(t *testing.T) {
 			remoteFiles <- test.remote
 			close(remoteFiles)
 		}()
-		files := compare(localFiles, remoteFiles, logger)
+		files, _ := compare(&Config{Strategy: test.strategy}, localFiles, remoteFiles, logger)
 		var updates []*FileStat
 		for f := range files {
 			updates = append(updates, f)
@@ -68,9 +142,109 @@ func TestCompare(t *testing.T) {
 		actual := len(updates) > 0
 		if actual != test.shouldSync {
 			t.Errorf("Expected sync %t, but got %t\n", test.shouldSync, actual)
-			t.Errorf("%s\n", updates[0])
+			if actual {
+				t.Errorf("%s\n", updates[0])
+			}
 			t.Errorf("%s\n", buf)
 		}
 
 	}
 }
+
+func TestParseS3Uri(t *testing.T) {
+	tests := []struct {
+		in     string
+		bucket string
+		prefix string
+		err    bool
+	}{
+		{in: "s3://bucket", bucket: "bucket", prefix: ""},
+		{in: "s3://bucket/", bucket: "bucket", prefix: ""},
+		{in: "s3://bucket/www", bucket: "bucket", prefix: "www"},
+		{in: "s3://bucket/www/", bucket: "bucket", prefix: "www"},
+		{in: "s3://bucket/www/assets", bucket: "bucket", prefix: "www/assets"},
+		{in: "http://bucket/www", err: true},
+		{in: "s3:///www", err: true},
+		{in: "/var/www", err: true},
+	}
+
+	for _, test := range tests {
+		bucket, prefix, err := parseS3Uri(test.in)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseS3Uri(%q) expected an error", test.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseS3Uri(%q) returned unexpected error %v", test.in, err)
+			continue
+		}
+		if bucket != test.bucket || prefix != test.prefix {
+			t.Errorf("parseS3Uri(%q) => (%q, %q), want (%q, %q)", test.in, bucket, prefix, test.bucket, test.prefix)
+		}
+	}
+}
+
+func TestCompareExtraneous(t *testing.T) {
+	logger, buf := getTestLogger()
+	localFiles := make(chan *FileStat)
+	remoteFiles := make(chan *FileStat)
+	go func() {
+		localFiles <- &FileStat{Name: "file.html", Size: 1}
+		close(localFiles)
+	}()
+	go func() {
+		remoteFiles <- &FileStat{Name: "file.html", Size: 1}
+		remoteFiles <- &FileStat{Name: "removed.html", Size: 1}
+		remoteFiles <- &FileStat{Name: "dir/removed.html", Size: 1}
+		close(remoteFiles)
+	}()
+	files, extraneous := compare(&Config{}, localFiles, remoteFiles, logger)
+	for range files {
+	}
+	removed := <-extraneous
+	if len(removed) != 2 {
+		t.Errorf("Expected 2 files only in destination, got %d\n", len(removed))
+		t.Errorf("%s\n", buf)
+	}
+}
+
+func TestCompareExtraneousWithErrors(t *testing.T) {
+	logger, _ := getTestLogger()
+	localFiles := make(chan *FileStat)
+	remoteFiles := make(chan *FileStat)
+	go func() {
+		localFiles <- &FileStat{Err: errors.New("permission denied")}
+		close(localFiles)
+	}()
+	go func() {
+		remoteFiles <- &FileStat{Name: "file.html", Size: 1}
+		close(remoteFiles)
+	}()
+	files, extraneous := compare(&Config{}, localFiles, remoteFiles, logger)
+	for range files {
+	}
+	if removed := <-extraneous; len(removed) != 0 {
+		t.Errorf("Expected no files to delete when the source couldn't be read, got %d\n", len(removed))
+	}
+}
+
+func TestNewSyncStrategy(t *testing.T) {
+	if _, err := newSyncStrategy(strategyOptions{SizeOnly: true, ExactTimestamps: true}); err == nil {
+		t.Error("Expected an error when using -size-only and -exact-timestamps together")
+	}
+	if _, err := newSyncStrategy(strategyOptions{SizeOnly: true, Checksum: true}); err == nil {
+		t.Error("Expected an error when using -size-only and -checksum together")
+	}
+	if _, err := newSyncStrategy(strategyOptions{IgnoreExisting: true, Existing: true}); err == nil {
+		t.Error("Expected an error when using -ignore-existing and -existing together")
+	}
+	strategy, err := newSyncStrategy(strategyOptions{SizeOnly: true, Existing: true})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if s, ok := strategy.(existingStrategy); !ok || s.next != (sizeOnlyStrategy{}) {
+		t.Errorf("Expected existingStrategy wrapping sizeOnlyStrategy, got %#v", strategy)
+	}
+}
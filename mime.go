@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// defaultContentType is used for empty files and files where the content type can't be detected
+const defaultContentType = "application/octet-stream"
+
+// builtinMimeTypes are the content types for common file extensions on websites. Sniffing the content can't tell css
+// and javascript from plain text, or svg from xml, and browsers refuse to use them with the wrong type.
+var builtinMimeTypes = map[string]string{
+	".aac":         "audio/aac",
+	".avif":        "image/avif",
+	".bmp":         "image/bmp",
+	".css":         "text/css; charset=utf-8",
+	".csv":         "text/csv; charset=utf-8",
+	".doc":         "application/msword",
+	".docx":        "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".eot":         "application/vnd.ms-fontobject",
+	".epub":        "application/epub+zip",
+	".gif":         "image/gif",
+	".gz":          "application/gzip",
+	".htm":         "text/html; charset=utf-8",
+	".html":        "text/html; charset=utf-8",
+	".ico":         "image/vnd.microsoft.icon",
+	".ics":         "text/calendar; charset=utf-8",
+	".jpeg":        "image/jpeg",
+	".jpg":         "image/jpeg",
+	".js":          "text/javascript; charset=utf-8",
+	".json":        "application/json",
+	".jsonld":      "application/ld+json",
+	".map":         "application/json",
+	".md":          "text/markdown; charset=utf-8",
+	".mjs":         "text/javascript; charset=utf-8",
+	".mp3":         "audio/mpeg",
+	".mp4":         "video/mp4",
+	".mpeg":        "video/mpeg",
+	".oga":         "audio/ogg",
+	".ogg":         "audio/ogg",
+	".ogv":         "video/ogg",
+	".otf":         "font/otf",
+	".pdf":         "application/pdf",
+	".png":         "image/png",
+	".rss":         "application/rss+xml",
+	".svg":         "image/svg+xml",
+	".tar":         "application/x-tar",
+	".tif":         "image/tiff",
+	".tiff":        "image/tiff",
+	".ttf":         "font/ttf",
+	".txt":         "text/plain; charset=utf-8",
+	".wasm":        "application/wasm",
+	".wav":         "audio/wav",
+	".weba":        "audio/webm",
+	".webm":        "video/webm",
+	".webmanifest": "application/manifest+json",
+	".webp":        "image/webp",
+	".woff":        "font/woff",
+	".woff2":       "font/woff2",
+	".xhtml":       "application/xhtml+xml",
+	".xls":         "application/vnd.ms-excel",
+	".xlsx":        "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".xml":         "application/xml",
+	".zip":         "application/zip",
+}
+
+// MimeTypes maps file extensions, with the leading dot and in lower case, to content types. A nil MimeTypes uses the
+// built in types.
+type MimeTypes map[string]string
+
+// newMimeTypes returns a copy of the built in types, that can be extended with mime.types files
+func newMimeTypes() MimeTypes {
+	types := make(MimeTypes, len(builtinMimeTypes))
+	for ext, contentType := range builtinMimeTypes {
+		types[ext] = contentType
+	}
+	return types
+}
+
+// load adds the types in a mime.types file, where each line is a content type followed by its extensions, e.g.
+// "text/css css". Types in the file takes precedence over the built in types.
+func (m MimeTypes) load(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		for _, ext := range fields[1:] {
+			m["."+strings.ToLower(strings.TrimPrefix(ext, "."))] = fields[0]
+		}
+	}
+	return scanner.Err()
+}
+
+// contentType returns the content type for the file with the name, from its extension or by sniffing the first 512
+// bytes of its content. The content is rewound to the start afterwards.
+func (m MimeTypes) contentType(name string, content io.ReadSeeker, size int64) (string, error) {
+	types := m
+	if types == nil {
+		types = builtinMimeTypes
+	}
+	if contentType, ok := types[strings.ToLower(path.Ext(name))]; ok {
+		return contentType, nil
+	}
+	// Don't try to detect content types on empty files
+	if size == 0 {
+		return defaultContentType, nil
+	}
+	// detect the ContentType in the first 512 bytes of the file
+	magicBytes := make([]byte, 512)
+	n, err := content.Read(magicBytes)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(magicBytes[:n]), nil
+}
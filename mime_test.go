@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMimeTypesContentType(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{name: "site.css", content: "body { color: red; }", expected: "text/css; charset=utf-8"},
+		{name: "app.js", content: "alert(1);", expected: "text/javascript; charset=utf-8"},
+		{name: "logo.svg", content: "<?xml version=\"1.0\"?><svg></svg>", expected: "image/svg+xml"},
+		{name: "LOGO.PNG", content: "not really a png", expected: "image/png"},
+		{name: "empty.css", content: "", expected: "text/css; charset=utf-8"},
+		{name: "empty", content: "", expected: "application/octet-stream"},
+		{name: "README", content: "some text", expected: "text/plain; charset=utf-8"},
+		{name: "page", content: "<html><body></body></html>", expected: "text/html; charset=utf-8"},
+	}
+	for _, test := range tests {
+		content := strings.NewReader(test.content)
+		actual, err := MimeTypes(nil).contentType(test.name, content, int64(len(test.content)))
+		if err != nil {
+			t.Errorf("contentType(%q) failed: %v", test.name, err)
+			continue
+		}
+		if actual != test.expected {
+			t.Errorf("contentType(%q) => %q, want %q", test.name, actual, test.expected)
+		}
+		if pos, _ := content.Seek(0, io.SeekCurrent); pos != 0 {
+			t.Errorf("contentType(%q) didn't rewind the content", test.name)
+		}
+	}
+}
+
+func TestMimeTypesLoad(t *testing.T) {
+	file, err := ioutil.TempFile("", "s3sync-mime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Remove(file.Name())
+	}()
+	if _, err := file.WriteString("# comment\ntext/x-custom  cst custom\napplication/x-empty\ntext/plain txt # overridden\n"); err != nil {
+		t.Fatal(err)
+	}
+	_ = file.Close()
+
+	types := newMimeTypes()
+	if err := types.load(file.Name()); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		".cst":    "text/x-custom",
+		".custom": "text/x-custom",
+		".txt":    "text/plain",
+		".css":    "text/css; charset=utf-8",
+	}
+	for ext, contentType := range expected {
+		if types[ext] != contentType {
+			t.Errorf("type for %s is %q, want %q", ext, types[ext], contentType)
+		}
+	}
+	if builtinMimeTypes[".txt"] != "text/plain; charset=utf-8" {
+		t.Error("loading a mime.types file changed the built in types")
+	}
+}
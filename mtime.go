@@ -0,0 +1,54 @@
+package main
+
+import (
+	"time"
+)
+
+// metaMtime is the metadata with the modified time of the local file an object was uploaded from. The LastModified
+// time of objects is when they were uploaded, which is later than the modified time of the file.
+const metaMtime = "mtime"
+
+// formatMtime formats a modified time for the metadata, with the full precision of the file system
+func formatMtime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// applyMtimeMetadata changes the ModTime of a remote file to the modified time of the original file, if it's in the
+// metadata
+func applyMtimeMetadata(file *FileStat) {
+	if value, ok := file.Metadata[metaMtime]; ok {
+		if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			file.ModTime = t
+		}
+	}
+}
+
+// comparesModTimes returns true if the strategy can decide to sync a file because of its modified time
+func comparesModTimes(strategy SyncStrategy) bool {
+	switch s := strategy.(type) {
+	case defaultStrategy, exactTimestampsStrategy:
+		return true
+	case existingStrategy:
+		return comparesModTimes(s.next)
+	}
+	return false
+}
+
+// remoteFile returns the file that is an s3 object when one of the files is local and the other is remote, otherwise
+// nil. Only s3 objects have an ETag.
+func remoteFile(source, dest *FileStat) *FileStat {
+	switch {
+	case source.ETag != "" && dest.ETag == "":
+		return source
+	case dest.ETag != "" && source.ETag == "":
+		return dest
+	}
+	return nil
+}
+
+// needsMtime returns true if the files have the same size, so the strategy has decided to sync them because of their
+// modified times, and the remote file hasn't been fetched with HeadObject to get the modified time in its metadata
+func needsMtime(strategy SyncStrategy, source, dest *FileStat) bool {
+	remote := remoteFile(source, dest)
+	return remote != nil && remote.Metadata == nil && source.Size == dest.Size && comparesModTimes(strategy)
+}
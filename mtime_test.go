@@ -0,0 +1,128 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestApplyMtimeMetadata(t *testing.T) {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 123456789, time.FixedZone("NZDT", 13*3600))
+	file := &FileStat{ModTime: time.Now(), Metadata: map[string]string{metaMtime: formatMtime(mtime)}}
+	applyMtimeMetadata(file)
+	if !file.ModTime.Equal(mtime) {
+		t.Errorf("ModTime is %s, want %s", file.ModTime, mtime)
+	}
+
+	uploaded := time.Now()
+	invalid := &FileStat{ModTime: uploaded, Metadata: map[string]string{metaMtime: "yesterday"}}
+	applyMtimeMetadata(invalid)
+	if !invalid.ModTime.Equal(uploaded) {
+		t.Errorf("expected an invalid mtime to be ignored, got %s", invalid.ModTime)
+	}
+}
+
+func TestNeedsMtime(t *testing.T) {
+	local := &FileStat{Name: "index.html", Size: 10}
+	remote := &FileStat{Name: "index.html", Size: 10, ETag: "abc"}
+	tests := []struct {
+		strategy SyncStrategy
+		source   *FileStat
+		dest     *FileStat
+		expected bool
+	}{
+		{strategy: defaultStrategy{}, source: local, dest: remote, expected: true},
+		{strategy: defaultStrategy{}, source: remote, dest: local, expected: true},
+		{strategy: existingStrategy{next: exactTimestampsStrategy{}}, source: local, dest: remote, expected: true},
+		{strategy: sizeOnlyStrategy{}, source: local, dest: remote, expected: false},
+		{strategy: checksumStrategy{}, source: local, dest: remote, expected: false},
+		{strategy: defaultStrategy{}, source: local, dest: &FileStat{Name: "index.html", Size: 11, ETag: "abc"}, expected: false},
+		{strategy: defaultStrategy{}, source: local, dest: &FileStat{Name: "index.html", Size: 10, ETag: "abc", Metadata: map[string]string{}}, expected: false},
+		// copying between buckets, both files are s3 objects
+		{strategy: defaultStrategy{}, source: remote, dest: remote, expected: false},
+	}
+	for i, test := range tests {
+		if actual := needsMtime(test.strategy, test.source, test.dest); actual != test.expected {
+			t.Errorf("test %d: needsMtime => %t, want %t", i, actual, test.expected)
+		}
+	}
+}
+
+func TestCompareWithMtimeMetadata(t *testing.T) {
+	logger, _ := getTestLogger()
+	deployed := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	modified := deployed.Add(-time.Hour)
+	touched := deployed.Add(time.Hour)
+	config := &Config{Bucket: "bucket", S3Service: &headMock{heads: map[string]*s3.HeadObjectOutput{
+		"www/same.html":    {Metadata: map[string]*string{"Mtime": aws.String(formatMtime(touched))}},
+		"www/changed.html": {Metadata: map[string]*string{"Mtime": aws.String(formatMtime(modified))}},
+		"www/old.html":     {Metadata: map[string]*string{}},
+	}}}
+
+	local := make(chan *FileStat, 4)
+	remote := make(chan *FileStat, 4)
+	for _, name := range []string{"same.html", "changed.html", "old.html"} {
+		local <- &FileStat{Name: name, Path: "/var/www/" + name, Size: 10, ModTime: touched}
+		remote <- &FileStat{Name: name, Path: "www/" + name, Size: 10, ModTime: deployed, ETag: "abc"}
+	}
+	// an older local file is skipped without a HeadObject call
+	local <- &FileStat{Name: "older.html", Path: "/var/www/older.html", Size: 10, ModTime: modified}
+	remote <- &FileStat{Name: "older.html", Path: "www/older.html", Size: 10, ModTime: deployed, ETag: "abc"}
+	close(local)
+	close(remote)
+
+	files, _ := compare(config, local, remote, logger)
+	var synced []string
+	for file := range files {
+		synced = append(synced, file.Name)
+	}
+	sort.Strings(synced)
+	if len(synced) != 2 || synced[0] != "changed.html" || synced[1] != "old.html" {
+		t.Errorf("expected changed.html and old.html to sync, got %v", synced)
+	}
+}
+
+func TestDownloadComparesLastModified(t *testing.T) {
+	logger, buf := getTestLogger()
+	deployed := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	modified := deployed.Add(-time.Hour)
+	mock := &headMock{heads: map[string]*s3.HeadObjectOutput{
+		"www/index.html": {Metadata: map[string]*string{"Mtime": aws.String(formatMtime(modified))}},
+	}}
+	config := &Config{Mode: Download, Bucket: "bucket", S3Service: mock}
+
+	file := &FileStat{Name: "index.html", Path: "www/index.html", Size: 10, ModTime: deployed, ETag: "abc"}
+	if err := headObject(config, file); err != nil {
+		t.Fatal(err)
+	}
+	if !file.ModTime.Equal(deployed) {
+		t.Errorf("expected downloads to keep the LastModified time, got %s", file.ModTime)
+	}
+
+	// files are compared with the LastModified time, only the file that is downloaded is fetched with HeadObject
+	config.S3Service = &headMock{heads: map[string]*s3.HeadObjectOutput{"www/about.html": {}}}
+	remote := make(chan *FileStat, 2)
+	local := make(chan *FileStat, 2)
+	for _, name := range []string{"index.html", "about.html"} {
+		remote <- &FileStat{Name: name, Path: "www/" + name, Size: 10, ModTime: deployed, ETag: "abc"}
+	}
+	local <- &FileStat{Name: "index.html", Path: "/var/www/index.html", Size: 10, ModTime: deployed}
+	local <- &FileStat{Name: "about.html", Path: "/var/www/about.html", Size: 10, ModTime: modified}
+	close(remote)
+	close(local)
+	files, _ := compare(config, remote, local, logger)
+	var synced []string
+	for file := range files {
+		synced = append(synced, file.Name)
+	}
+	if len(synced) != 1 || synced[0] != "about.html" {
+		t.Errorf("expected only the older about.html to be downloaded, got %v", synced)
+	}
+	if strings.Contains(buf.String(), "s3://bucket/www/index.html") {
+		t.Errorf("expected the unchanged index.html to not be fetched with HeadObject, got %s", buf)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileOwner returns the uid and gid of the file, ok is false if they aren't known
+func fileOwner(stat os.FileInfo) (uid, gid int, ok bool) {
+	if sys, ok := stat.Sys().(*syscall.Stat_t); ok {
+		return int(sys.Uid), int(sys.Gid), true
+	}
+	return 0, 0, false
+}
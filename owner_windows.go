@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "os"
+
+// fileOwner returns false since files on windows don't have a uid and gid
+func fileOwner(stat os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
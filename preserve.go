@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// Metadata that stores the attributes of the uploaded file
+const (
+	metaMode   = "mode"
+	metaUID    = "uid"
+	metaGID    = "gid"
+	metaOwner  = "owner"
+	metaGroup  = "group"
+	metaXattrs = "xattrs"
+)
+
+var errXattrsNotSupported = errors.New("extended attributes are only supported on linux")
+
+// maxMetadataSize is the most user metadata s3 accepts for an object, counted as the length of all keys and values
+const maxMetadataSize = 2 * 1024
+
+// defaultXattrs are the extended attributes that are preserved when no patterns are given, the other namespaces are
+// used by the system and security modules
+const defaultXattrs = "user.*"
+
+// Preserve decides which attributes of files that are stored in the metadata of uploaded objects and restored when
+// they are downloaded. All methods are safe on a nil Preserve, which preserves nothing.
+type Preserve struct {
+	Mode      bool
+	Ownership bool
+	Xattrs    bool
+	// NumericIDs stores and restores only the uid and gid, otherwise the user and group names are used when they
+	// exist on both systems
+	NumericIDs bool
+
+	xattrs []*glob
+}
+
+// parsePreserve returns the Preserve for a comma separated list of attributes, like "mode,ownership", and the patterns
+// of the extended attributes to preserve
+func parsePreserve(value string, xattrPatterns []string, numericIDs bool) (*Preserve, error) {
+	if value == "" {
+		return nil, nil
+	}
+	p := &Preserve{NumericIDs: numericIDs}
+	for _, attr := range strings.Split(value, ",") {
+		switch strings.TrimSpace(attr) {
+		case "mode":
+			p.Mode = true
+		case "ownership":
+			p.Ownership = true
+		case "xattrs":
+			if !xattrsSupported {
+				return nil, errXattrsNotSupported
+			}
+			p.Xattrs = true
+		case "all":
+			p.Mode, p.Ownership, p.Xattrs = true, true, xattrsSupported
+		default:
+			return nil, fmt.Errorf("unknown attribute '%s', use mode, ownership, xattrs or all", attr)
+		}
+	}
+	if len(xattrPatterns) == 0 {
+		xattrPatterns = []string{defaultXattrs}
+	}
+	for _, pattern := range xattrPatterns {
+		g, err := compileGlob(pattern, globOptions{})
+		if err != nil {
+			return nil, err
+		}
+		p.xattrs = append(p.xattrs, g)
+	}
+	return p, nil
+}
+
+// preservedXattr returns true if the extended attribute with the name matches one of the patterns
+func (p *Preserve) preservedXattr(name string) bool {
+	for _, g := range p.xattrs {
+		if g.match(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// metadata returns the attributes of the file at path as object metadata
+func (p *Preserve) metadata(path string, stat os.FileInfo) (map[string]*string, error) {
+	if p == nil {
+		return nil, nil
+	}
+	metadata := make(map[string]*string)
+	if p.Mode {
+		metadata[metaMode] = aws.String(formatMode(stat.Mode()))
+	}
+	if uid, gid, ok := fileOwner(stat); ok && p.Ownership {
+		metadata[metaUID] = aws.String(strconv.Itoa(uid))
+		metadata[metaGID] = aws.String(strconv.Itoa(gid))
+		if !p.NumericIDs {
+			if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+				metadata[metaOwner] = aws.String(u.Username)
+			}
+			if g, err := user.LookupGroupId(strconv.Itoa(gid)); err == nil {
+				metadata[metaGroup] = aws.String(g.Name)
+			}
+		}
+	}
+	if p.Xattrs {
+		names, err := listXattrs(path)
+		if err != nil {
+			return nil, err
+		}
+		xattrs := make(map[string]string)
+		for _, name := range names {
+			if !p.preservedXattr(name) {
+				continue
+			}
+			value, err := getXattr(path, name)
+			if err != nil {
+				return nil, err
+			}
+			xattrs[name] = base64.StdEncoding.EncodeToString(value)
+		}
+		if len(xattrs) > 0 {
+			encoded, err := json.Marshal(xattrs)
+			if err != nil {
+				return nil, err
+			}
+			metadata[metaXattrs] = aws.String(string(encoded))
+		}
+	}
+	return metadata, nil
+}
+
+// restore sets the attributes in the metadata of an object on the downloaded file at path. Ownership can only be
+// changed by root, so it's left as it is when it's not allowed. The owner is changed before the mode, as changing the
+// owner clears the setuid and setgid bits.
+func (p *Preserve) restore(path string, metadata map[string]string) error {
+	if p == nil {
+		return nil
+	}
+	if p.Ownership {
+		uid, gid := p.owner(metadata)
+		if uid >= 0 || gid >= 0 {
+			if err := os.Lchown(path, uid, gid); err != nil && !os.IsPermission(err) {
+				return err
+			}
+		}
+	}
+	if value, ok := metadata[metaMode]; ok && p.Mode {
+		mode, err := parseMode(value)
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+	}
+	if value, ok := metadata[metaXattrs]; ok && p.Xattrs {
+		var xattrs map[string]string
+		if err := json.Unmarshal([]byte(value), &xattrs); err != nil {
+			return fmt.Errorf("invalid xattrs metadata: %v", err)
+		}
+		for name, encoded := range xattrs {
+			if !p.preservedXattr(name) {
+				continue
+			}
+			value, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return fmt.Errorf("invalid value of the xattr %s: %v", name, err)
+			}
+			if err := setXattr(path, name, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// dropLargeXattrs removes the extended attributes from the metadata of an object if the metadata is larger than s3
+// accepts, the upload would fail otherwise. It returns true if they were removed.
+func dropLargeXattrs(metadata map[string]*string) bool {
+	if _, ok := metadata[metaXattrs]; !ok {
+		return false
+	}
+	size := 0
+	for key, value := range metadata {
+		size += len(key) + len(aws.StringValue(value))
+	}
+	if size <= maxMetadataSize {
+		return false
+	}
+	delete(metadata, metaXattrs)
+	return true
+}
+
+// owner returns the uid and gid to restore from the metadata, or -1 for the ones that are unknown. The user and
+// group names are preferred unless NumericIDs is set, as the ids can be different on another system.
+func (p *Preserve) owner(metadata map[string]string) (int, int) {
+	uid, gid := -1, -1
+	if id, err := strconv.Atoi(metadata[metaUID]); err == nil {
+		uid = id
+	}
+	if id, err := strconv.Atoi(metadata[metaGID]); err == nil {
+		gid = id
+	}
+	if p.NumericIDs {
+		return uid, gid
+	}
+	if name, ok := metadata[metaOwner]; ok {
+		if u, err := user.Lookup(name); err == nil {
+			if id, err := strconv.Atoi(u.Uid); err == nil {
+				uid = id
+			}
+		}
+	}
+	if name, ok := metadata[metaGroup]; ok {
+		if g, err := user.LookupGroup(name); err == nil {
+			if id, err := strconv.Atoi(g.Gid); err == nil {
+				gid = id
+			}
+		}
+	}
+	return uid, gid
+}
+
+// formatMode formats the permissions and the setuid, setgid and sticky bits of a file as an octal number, like chmod
+// takes them
+func formatMode(mode os.FileMode) string {
+	bits := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return fmt.Sprintf("%04o", bits)
+}
+
+// parseMode parses an octal mode from formatMode
+func parseMode(value string) (os.FileMode, error) {
+	bits, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || bits > 07777 {
+		return 0, fmt.Errorf("invalid mode '%s'", value)
+	}
+	mode := os.FileMode(bits & 0777)
+	if bits&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if bits&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if bits&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode, nil
+}
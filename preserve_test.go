@@ -0,0 +1,142 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestFormatMode(t *testing.T) {
+	tests := []struct {
+		mode     os.FileMode
+		expected string
+	}{
+		{mode: 0644, expected: "0644"},
+		{mode: 0755 | os.ModeSetuid, expected: "4755"},
+		{mode: 0777 | os.ModeSticky | os.ModeSetgid, expected: "3777"},
+	}
+	for _, test := range tests {
+		actual := formatMode(test.mode)
+		if actual != test.expected {
+			t.Errorf("formatMode(%s) => %s, want %s", test.mode, actual, test.expected)
+		}
+		if mode, err := parseMode(actual); err != nil || mode != test.mode {
+			t.Errorf("parseMode(%s) => %s, %v, want %s", actual, mode, err, test.mode)
+		}
+	}
+	for _, invalid := range []string{"", "rw-r--r--", "0899", "17777"} {
+		if _, err := parseMode(invalid); err == nil {
+			t.Errorf("expected an error for the mode %q", invalid)
+		}
+	}
+}
+
+func TestParsePreserve(t *testing.T) {
+	if p, err := parsePreserve("", nil, false); p != nil || err != nil {
+		t.Errorf("expected nothing to be preserved, got %+v, %v", p, err)
+	}
+	p, err := parsePreserve("mode, ownership", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Mode || !p.Ownership || p.Xattrs || !p.NumericIDs {
+		t.Errorf("unexpected attributes %+v", p)
+	}
+	if _, err := parsePreserve("mode,acl", nil, false); err == nil {
+		t.Error("expected an error for an unknown attribute")
+	}
+
+	p, _ = parsePreserve("mode", []string{"user.checksum.*", "user.mime_type"}, false)
+	for name, expected := range map[string]bool{"user.checksum.sha256": true, "user.mime_type": true, "user.other": false} {
+		if actual := p.preservedXattr(name); actual != expected {
+			t.Errorf("preservedXattr(%q) => %t, want %t", name, actual, expected)
+		}
+	}
+}
+
+func TestPreserveOwner(t *testing.T) {
+	metadata := map[string]string{metaUID: "1001", metaGID: "1002", metaOwner: "s3sync-no-such-user", metaGroup: "s3sync-no-such-group"}
+	if uid, gid := (&Preserve{Ownership: true}).owner(metadata); uid != 1001 || gid != 1002 {
+		t.Errorf("expected the ids when the names don't exist, got %d and %d", uid, gid)
+	}
+	if uid, gid := (&Preserve{Ownership: true, NumericIDs: true}).owner(map[string]string{metaUID: "1001"}); uid != 1001 || gid != -1 {
+		t.Errorf("expected uid 1001 and an unknown gid, got %d and %d", uid, gid)
+	}
+}
+
+func TestPreserveMetadataAndRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3sync-preserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	source := filepath.Join(dir, "script.sh")
+	target := filepath.Join(dir, "restored.sh")
+	for _, path := range []string{source, target} {
+		if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(source, 0750); err != nil {
+		t.Fatal(err)
+	}
+	xattrs := xattrsSupported && setXattr(source, "user.s3sync", []byte("test")) == nil
+
+	p, err := parsePreserve("all", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := p.metadata(source, stat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.StringValue(metadata[metaMode]) != "0750" {
+		t.Errorf("expected the mode 0750, got %s", aws.StringValue(metadata[metaMode]))
+	}
+
+	// HeadObject returns the metadata with lower case keys after headObject
+	remote := make(map[string]string, len(metadata))
+	for key, value := range metadata {
+		remote[key] = aws.StringValue(value)
+	}
+	if err := p.restore(target, remote); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := os.Stat(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Mode().Perm() != 0750 {
+		t.Errorf("expected the restored mode to be 0750, got %s", restored.Mode())
+	}
+	if xattrs {
+		if value, err := getXattr(target, "user.s3sync"); err != nil || string(value) != "test" {
+			t.Errorf("expected the xattr user.s3sync to be restored, got %q, %v", value, err)
+		}
+	}
+}
+
+func TestDropLargeXattrs(t *testing.T) {
+	metadata := map[string]*string{metaMode: aws.String("0644"), metaXattrs: aws.String(`{"user.note":"c21hbGw="}`)}
+	if dropLargeXattrs(metadata) || metadata[metaXattrs] == nil {
+		t.Error("expected small xattrs to be kept")
+	}
+
+	metadata[metaXattrs] = aws.String(`{"user.note":"` + strings.Repeat("A", maxMetadataSize) + `"}`)
+	if !dropLargeXattrs(metadata) || metadata[metaXattrs] != nil {
+		t.Error("expected xattrs larger than the metadata limit to be removed")
+	}
+	if aws.StringValue(metadata[metaMode]) != "0644" {
+		t.Errorf("expected the other attributes to be kept, got %v", metadata)
+	}
+}
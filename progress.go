@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// progressTTYInterval is how often the progress line is redrawn on a terminal
+	progressTTYInterval = 250 * time.Millisecond
+	// progressLogInterval is how often a progress line is logged when stdout isn't a terminal
+	progressLogInterval = 10 * time.Second
+	// progressWindow is how far back in time the current throughput is calculated over
+	progressWindow = 10 * time.Second
+)
+
+// Progress keeps track of how many files and bytes that have been found to sync and how many that has been
+// transferred so far. The counters are updated from many goroutines, and all methods are no-ops on a nil Progress.
+type Progress struct {
+	totalFiles  int64
+	totalBytes  int64
+	doneFiles   int64
+	doneBytes   int64
+	listingDone int32
+
+	// parent is the Progress of the whole sync when this Progress counts one attempt at transferring a file
+	parent *Progress
+
+	start    time.Time
+	tty      bool
+	interval time.Duration
+
+	// mu protects the terminal, so that log lines and the progress line doesn't get mixed up
+	mu      sync.Mutex
+	out     io.Writer
+	drawn   bool
+	samples []progressSample
+	stop    chan bool
+	stopped chan bool
+}
+
+type progressSample struct {
+	at    time.Time
+	bytes int64
+}
+
+// NewProgress creates a Progress that redraws a progress line on out if it's a terminal, otherwise it logs a progress
+// line every progressLogInterval.
+func NewProgress(out *os.File, jsonOutput bool) *Progress {
+	p := &Progress{
+		start:    time.Now(),
+		out:      out,
+		interval: progressLogInterval,
+	}
+	if stat, err := out.Stat(); err == nil && stat.Mode()&os.ModeCharDevice != 0 && !jsonOutput {
+		p.tty = true
+		p.interval = progressTTYInterval
+	}
+	return p
+}
+
+// queued adds a file that will be transferred to the totals
+func (p *Progress) queued(file *FileStat) {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.totalFiles, 1)
+	atomic.AddInt64(&p.totalBytes, file.Size)
+}
+
+// listed marks that all files to sync has been found, so the totals are final
+func (p *Progress) listed() {
+	if p == nil {
+		return
+	}
+	atomic.StoreInt32(&p.listingDone, 1)
+}
+
+// transferred adds n bytes to the number of bytes that has been transferred
+func (p *Progress) transferred(n int64) {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.doneBytes, n)
+	p.parent.transferred(n)
+}
+
+// attempt returns a Progress for one attempt at transferring a file. The bytes it counts are added to p, and undo
+// takes them back if the attempt fails, as the next attempt transfers them again.
+func (p *Progress) attempt() *Progress {
+	if p == nil {
+		return nil
+	}
+	return &Progress{parent: p}
+}
+
+// undo removes the bytes that were counted by an attempt from the progress of the sync
+func (p *Progress) undo() {
+	if p == nil {
+		return
+	}
+	p.parent.transferred(-atomic.SwapInt64(&p.doneBytes, 0))
+}
+
+// fileDone marks that a file has finished transferring, successful or not
+func (p *Progress) fileDone() {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.doneFiles, 1)
+}
+
+// Start begins printing the progress until Stop is called
+func (p *Progress) Start(logger *Logger) {
+	if p == nil {
+		return
+	}
+	p.stop = make(chan bool)
+	p.stopped = make(chan bool)
+	go func() {
+		defer close(p.stopped)
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case now := <-ticker.C:
+				line := p.line(now)
+				if p.tty {
+					p.mu.Lock()
+					p.clear()
+					fmt.Fprint(p.out, line)
+					p.drawn = true
+					p.mu.Unlock()
+				} else {
+					logger.Event(&Event{Type: EventProgress, Message: line})
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops printing the progress and removes the progress line from the terminal
+func (p *Progress) Stop() {
+	if p == nil || p.stop == nil {
+		return
+	}
+	close(p.stop)
+	<-p.stopped
+	p.mu.Lock()
+	p.clear()
+	p.mu.Unlock()
+}
+
+// clear removes the progress line from the terminal, p.mu must be held
+func (p *Progress) clear() {
+	if p.drawn {
+		fmt.Fprint(p.out, "\r\033[K")
+		p.drawn = false
+	}
+}
+
+// Writer wraps w so that the progress line is cleared before anything is written, use it for log output that goes to
+// the same terminal as the progress line.
+func (p *Progress) Writer(w io.Writer) io.Writer {
+	if p == nil || !p.tty {
+		return w
+	}
+	return &progressWriter{progress: p, w: w}
+}
+
+type progressWriter struct {
+	progress *Progress
+	w        io.Writer
+}
+
+func (pw *progressWriter) Write(b []byte) (int, error) {
+	pw.progress.mu.Lock()
+	defer pw.progress.mu.Unlock()
+	pw.progress.clear()
+	return pw.w.Write(b)
+}
+
+// line formats the current progress, e.g. "Completed 3/10 files, 1.5 MiB/20.0 MiB (1.2 MiB/s), ETA 15s"
+func (p *Progress) line(now time.Time) string {
+	doneFiles := atomic.LoadInt64(&p.doneFiles)
+	totalFiles := atomic.LoadInt64(&p.totalFiles)
+	doneBytes := atomic.LoadInt64(&p.doneBytes)
+	totalBytes := atomic.LoadInt64(&p.totalBytes)
+	listingDone := atomic.LoadInt32(&p.listingDone) == 1
+
+	rate := p.rate(now, doneBytes)
+
+	more := ""
+	if !listingDone {
+		more = "+"
+	}
+	eta := "unknown"
+	if listingDone && rate > 0 {
+		eta = (time.Duration(float64(totalBytes-doneBytes)/rate) * time.Second).Round(time.Second).String()
+	}
+	return fmt.Sprintf("Completed %d/%d%s files, %s/%s%s (%s/s), ETA %s", doneFiles, totalFiles, more,
+		formatBytes(doneBytes), formatBytes(totalBytes), more, formatBytes(int64(rate)), eta)
+}
+
+// rate returns the current throughput in bytes per second, over the last progressWindow
+func (p *Progress) rate(now time.Time, doneBytes int64) float64 {
+	p.samples = append(p.samples, progressSample{at: now, bytes: doneBytes})
+	for len(p.samples) > 2 && now.Sub(p.samples[1].at) >= progressWindow {
+		p.samples = p.samples[1:]
+	}
+	oldest := p.samples[0]
+	if elapsed := now.Sub(oldest.at).Seconds(); elapsed > 0 {
+		return float64(doneBytes-oldest.bytes) / elapsed
+	}
+	if elapsed := now.Sub(p.start).Seconds(); elapsed > 0 {
+		return float64(doneBytes) / elapsed
+	}
+	return 0
+}
+
+// progressReader counts the bytes read from a file for the progress. The uploader reads parts of the file more than
+// once, first to calculate the signature and then to send it, so only bytes that haven't been read before are counted.
+// It implements io.ReaderAt and io.Seeker so the uploader can still read parts concurrently without buffering them.
+type progressReader struct {
+	file     *os.File
+	progress *Progress
+
+	mu   sync.Mutex
+	pos  int64
+	seen spans
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.file.Read(b)
+	r.mu.Lock()
+	r.progress.transferred(r.seen.add(r.pos, r.pos+int64(n)))
+	r.pos += int64(n)
+	r.mu.Unlock()
+	return n, err
+}
+
+func (r *progressReader) ReadAt(b []byte, off int64) (int, error) {
+	n, err := r.file.ReadAt(b, off)
+	r.mu.Lock()
+	r.progress.transferred(r.seen.add(off, off+int64(n)))
+	r.mu.Unlock()
+	return n, err
+}
+
+func (r *progressReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.file.Seek(offset, whence)
+	if err == nil {
+		r.mu.Lock()
+		r.pos = pos
+		r.mu.Unlock()
+	}
+	return pos, err
+}
+
+// progressWriterAt counts the bytes written to a file for the progress when downloading. The downloader writes a part
+// again when reading its body fails, so like progressReader only bytes that haven't been written before are counted.
+type progressWriterAt struct {
+	w        io.WriterAt
+	progress *Progress
+
+	mu   sync.Mutex
+	seen spans
+}
+
+func (w *progressWriterAt) WriteAt(b []byte, off int64) (int, error) {
+	n, err := w.w.WriteAt(b, off)
+	w.mu.Lock()
+	w.progress.transferred(w.seen.add(off, off+int64(n)))
+	w.mu.Unlock()
+	return n, err
+}
+
+// spans keeps track of which byte ranges that have been seen, as a sorted list of non overlapping [start, end) ranges
+type spans [][2]int64
+
+// add marks the range [start, end) as seen and returns how many of those bytes that hadn't been seen before
+func (s *spans) add(start, end int64) int64 {
+	if end <= start {
+		return 0
+	}
+	newBytes := end - start
+	var merged [][2]int64
+	for _, span := range *s {
+		if span[1] < start || span[0] > end {
+			merged = append(merged, span)
+			continue
+		}
+		// overlapping or touching, remove the overlap from the new bytes and grow the range
+		if overlap := min64(span[1], end) - max64(span[0], start); overlap > 0 {
+			newBytes -= overlap
+		}
+		start, end = min64(span[0], start), max64(span[1], end)
+	}
+	merged = append(merged, [2]int64{start, end})
+	for i := len(merged) - 1; i > 0 && merged[i][0] < merged[i-1][0]; i-- {
+		merged[i], merged[i-1] = merged[i-1], merged[i]
+	}
+	*s = merged
+	return newBytes
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
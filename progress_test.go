@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+func TestSpans(t *testing.T) {
+	var s spans
+	steps := []struct {
+		start, end int64
+		expected   int64
+	}{
+		{0, 10, 10},
+		{0, 10, 0},
+		{5, 15, 5},
+		{20, 30, 10},
+		{10, 25, 5},
+		{0, 40, 10},
+		{40, 40, 0},
+	}
+	for _, step := range steps {
+		if actual := s.add(step.start, step.end); actual != step.expected {
+			t.Errorf("add(%d, %d) => %d new bytes, want %d", step.start, step.end, actual, step.expected)
+		}
+	}
+	if len(s) != 1 || s[0] != [2]int64{0, 40} {
+		t.Errorf("Expected one span [0, 40), got %v", s)
+	}
+}
+
+func TestProgressReader(t *testing.T) {
+	file, err := os.Open("./_testdata/file_33.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	progress := &Progress{}
+	r := &progressReader{file: file, progress: progress}
+	// read it all twice, the same way the uploader first signs and then sends the body
+	for i := 0; i < 2; i++ {
+		if _, err := io.Copy(ioutil.Discard, io.NewSectionReader(r, 0, 34)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if progress.doneBytes != 34 {
+		t.Errorf("Expected 34 bytes transferred, got %d", progress.doneBytes)
+	}
+}
+
+// flakyGetMock returns an object whose body breaks off halfway for the first failures calls
+type flakyGetMock struct {
+	s3iface.S3API
+	content  []byte
+	failures int
+}
+
+func (m *flakyGetMock) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	var body io.Reader = bytes.NewReader(m.content)
+	if m.failures > 0 {
+		m.failures--
+		body = io.MultiReader(bytes.NewReader(m.content[:len(m.content)/2]), brokenReader{})
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(body), ContentLength: aws.Int64(int64(len(m.content)))}, nil
+}
+
+// MaxRetries makes the downloader read the body of a part twice before it gives up
+func (m *flakyGetMock) HeadObject(*s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	return &s3.HeadObjectOutput{}, nil
+}
+
+func (m *flakyGetMock) MaxRetries() int {
+	return 1
+}
+
+// brokenReader is a connection that breaks off
+type brokenReader struct{}
+
+func (brokenReader) Read([]byte) (int, error) {
+	return 0, io.ErrUnexpectedEOF
+}
+
+func TestProgressRetriedDownload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3sync-progress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	logger, _ := getTestLogger()
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	// the downloader reads the body twice, so the first attempt writes half the object twice before it fails
+	config := &Config{
+		Mode:      Download,
+		Bucket:    "bucket",
+		LocalPath: dir,
+		S3Service: &flakyGetMock{content: content, failures: 2},
+		Progress:  &Progress{},
+		Retry:     &RetryPolicy{MaxAttempts: 2, sleep: func(time.Duration) {}},
+		Summary:   NewSummary(),
+	}
+	file := &FileStat{Name: "data.bin", Path: "data.bin", Size: int64(len(content))}
+	config.Progress.queued(file)
+	in := make(chan *FileStat, 1)
+	in <- file
+	close(in)
+	syncFiles(config, in, logger)
+
+	if !config.Summary.success() {
+		t.Fatalf("expected the download to succeed on the second attempt")
+	}
+	if downloaded, err := ioutil.ReadFile(filepath.Join(dir, "data.bin")); err != nil || !bytes.Equal(downloaded, content) {
+		t.Fatalf("expected the whole object to be downloaded, got %d bytes and %v", len(downloaded), err)
+	}
+	if config.Progress.doneBytes != config.Progress.totalBytes {
+		t.Errorf("expected %d bytes done, got %d", config.Progress.totalBytes, config.Progress.doneBytes)
+	}
+}
+
+func TestProgressLine(t *testing.T) {
+	start := time.Now()
+	progress := &Progress{start: start}
+	progress.queued(&FileStat{Size: 1024 * 1024})
+	progress.queued(&FileStat{Size: 1024 * 1024})
+
+	progress.line(start)
+	progress.transferred(1024 * 1024)
+	progress.fileDone()
+	line := progress.line(start.Add(time.Second))
+	expected := "Completed 1/2+ files, 1.0 MiB/2.0 MiB+ (1.0 MiB/s), ETA unknown"
+	if line != expected {
+		t.Errorf("Expected %q, got %q", expected, line)
+	}
+
+	progress.listed()
+	line = progress.line(start.Add(2 * time.Second))
+	if !strings.HasSuffix(line, "ETA 2s") {
+		t.Errorf("Expected an ETA of 2s, got %q", line)
+	}
+
+	var nilProgress *Progress
+	nilProgress.queued(&FileStat{Size: 1})
+	nilProgress.transferred(1)
+	nilProgress.Stop()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// retryableCodes are AWS error codes for failures that might succeed if the request is tried again
+var retryableCodes = map[string]bool{
+	"RequestError":              true,
+	"RequestTimeout":            true,
+	"ResponseTimeout":           true,
+	"SlowDown":                  true,
+	"Throttling":                true,
+	"ThrottlingException":       true,
+	"RequestLimitExceeded":      true,
+	"RequestThrottled":          true,
+	"InternalError":             true,
+	"ServiceUnavailable":        true,
+	"ExpiredToken":              true,
+	"ExpiredTokenException":     true,
+	"RequestExpired":            true,
+	"TokenRefreshRequired":      true,
+	"OperationAborted":          true,
+	"IncompleteBody":            true,
+	"XAmzContentSHA256Mismatch": true,
+}
+
+// RetryPolicy decides how many times a failed transfer is tried and how long to wait between the attempts
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, 1 means that failures are never retried
+	MaxAttempts int
+	// BaseDelay is the longest wait before the first retry, it's doubled for each retry
+	BaseDelay time.Duration
+	// MaxDelay caps the wait between attempts
+	MaxDelay time.Duration
+
+	// sleep is replaced in tests
+	sleep func(time.Duration)
+}
+
+// do calls fn until it succeeds, fails with an error that isn't retryable or MaxAttempts has been reached. It returns
+// the number of attempts and the last error. It's safe to call on a nil RetryPolicy, then fn is called once.
+func (p *RetryPolicy) do(fn func() error, onRetry func(attempt int, err error, wait time.Duration)) (int, error) {
+	attempt := 1
+	for {
+		err := fn()
+		if err == nil || p == nil || attempt >= p.MaxAttempts || !isRetryable(err) {
+			return attempt, err
+		}
+		wait := p.delay(attempt)
+		if onRetry != nil {
+			onRetry(attempt, err, wait)
+		}
+		sleep := p.sleep
+		if sleep == nil {
+			sleep = time.Sleep
+		}
+		sleep(wait)
+		attempt++
+	}
+}
+
+// delay returns a random wait between 0 and BaseDelay * 2^(attempt-1) capped by MaxDelay, "full jitter" so that many
+// concurrent transfers that fail at the same time don't retry at the same time.
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+	backoff := p.BaseDelay
+	for i := 1; i < attempt && (p.MaxDelay <= 0 || backoff < p.MaxDelay); i++ {
+		backoff *= 2
+	}
+	if p.MaxDelay > 0 && backoff > p.MaxDelay {
+		backoff = p.MaxDelay
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
+
+// isRetryable returns true for errors that are likely to be temporary, like throttling, server errors, timeouts,
+// connection resets and expired credentials. Errors like access denied, missing buckets or local files that can't be
+// read are permanent and retrying them would only make the sync slower.
+func isRetryable(err error) bool {
+	for err != nil {
+		if reqErr, ok := err.(awserr.RequestFailure); ok {
+			if reqErr.StatusCode() >= 500 || reqErr.StatusCode() == 429 {
+				return true
+			}
+		}
+		if awsErr, ok := err.(awserr.Error); ok {
+			if retryableCodes[awsErr.Code()] {
+				return true
+			}
+			// errors from s3manager wraps the error from the failing request
+			err = awsErr.OrigErr()
+			continue
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return true
+		}
+		if err == io.ErrUnexpectedEOF {
+			return true
+		}
+		msg := err.Error()
+		return strings.Contains(msg, "connection reset") || strings.Contains(msg, "broken pipe")
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"throttled", awserr.NewRequestFailure(awserr.New("SlowDown", "slow down", nil), 503, "id"), true},
+		{"server error", awserr.NewRequestFailure(awserr.New("Whatever", "oops", nil), 500, "id"), true},
+		{"too many requests", awserr.NewRequestFailure(awserr.New("Whatever", "slow", nil), 429, "id"), true},
+		{"connection", awserr.New("RequestError", "send request failed", errors.New("read: connection reset by peer")), true},
+		{"expired credentials", awserr.NewRequestFailure(awserr.New("ExpiredToken", "expired", nil), 400, "id"), true},
+		{"multipart wrapping", awserr.New("MultipartUpload", "upload multipart failed", awserr.New("RequestTimeout", "timeout", nil)), true},
+		{"timeout", timeoutError{}, true},
+		{"reset", errors.New("write tcp: connection reset by peer"), true},
+		{"access denied", awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, "id"), false},
+		{"no bucket", awserr.NewRequestFailure(awserr.New("NoSuchBucket", "no bucket", nil), 404, "id"), false},
+		{"multipart access denied", awserr.New("MultipartUpload", "upload multipart failed", awserr.New("AccessDenied", "denied", nil)), false},
+		{"local file", &os.PathError{Op: "open", Path: "/nope", Err: os.ErrNotExist}, false},
+		{"nil", nil, false},
+	}
+	for _, test := range tests {
+		if actual := isRetryable(test.err); actual != test.expected {
+			t.Errorf("isRetryable(%s) => %t, want %t", test.name, actual, test.expected)
+		}
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	var waits []time.Duration
+	policy := &RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   time.Second,
+		MaxDelay:    10 * time.Second,
+		sleep:       func(d time.Duration) { waits = append(waits, d) },
+	}
+	retryable := awserr.New("RequestError", "send request failed", nil)
+
+	calls := 0
+	attempts, err := policy.do(func() error {
+		calls++
+		if calls < 2 {
+			return retryable
+		}
+		return nil
+	}, nil)
+	if err != nil || attempts != 2 {
+		t.Errorf("Expected success after 2 attempts, got %d attempts and %v", attempts, err)
+	}
+
+	var retried []int
+	attempts, err = policy.do(func() error { return retryable }, func(attempt int, err error, wait time.Duration) {
+		retried = append(retried, attempt)
+	})
+	if err != retryable || attempts != 3 {
+		t.Errorf("Expected failure after 3 attempts, got %d attempts and %v", attempts, err)
+	}
+	if len(retried) != 2 {
+		t.Errorf("Expected 2 retries, got %v", retried)
+	}
+
+	permanent := errors.New("open /nope: no such file or directory")
+	attempts, err = policy.do(func() error { return permanent }, nil)
+	if err != permanent || attempts != 1 {
+		t.Errorf("Expected a permanent error to not be retried, got %d attempts and %v", attempts, err)
+	}
+
+	var nilPolicy *RetryPolicy
+	if attempts, _ := nilPolicy.do(func() error { return retryable }, nil); attempts != 1 {
+		t.Errorf("Expected a nil policy to try once, got %d attempts", attempts)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	policy := &RetryPolicy{BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+	for attempt := 1; attempt < 10; attempt++ {
+		max := time.Second << uint(attempt-1)
+		if max > policy.MaxDelay {
+			max = policy.MaxDelay
+		}
+		for i := 0; i < 100; i++ {
+			if d := policy.delay(attempt); d < 0 || d > max {
+				t.Fatalf("delay(%d) => %s, want between 0 and %s", attempt, d, max)
+			}
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// ObjectRule sets properties of the objects that are uploaded for files that matches Pattern. Empty properties are
+// left as they are.
+type ObjectRule struct {
+	Pattern            string `json:"pattern"`
+	ContentType        string `json:"content_type,omitempty"`
+	CacheControl       string `json:"cache_control,omitempty"`
+	ContentDisposition string `json:"content_disposition,omitempty"`
+	ContentLanguage    string `json:"content_language,omitempty"`
+	// Expires is a http date or a duration from the time of the upload, like "720h"
+	Expires string `json:"expires,omitempty"`
+	// Compress is the compression of the uploaded object, only "gzip" is supported
+	Compress string `json:"compress,omitempty"`
+	// ACL is a canned ACL like "public-read", it's also set on copied objects
+	ACL string `json:"acl,omitempty"`
+	// StorageClass is the storage class like "STANDARD_IA", it's also set on copied objects
+	StorageClass string `json:"storage_class,omitempty"`
+	// Tags are added to the tags of earlier rules, a tag with the same key replaces the earlier value
+	Tags map[string]string `json:"tags,omitempty"`
+
+	glob *glob
+}
+
+// merge sets the non empty properties of other on r
+func (r *ObjectRule) merge(other *ObjectRule) {
+	if other.ContentType != "" {
+		r.ContentType = other.ContentType
+	}
+	if other.CacheControl != "" {
+		r.CacheControl = other.CacheControl
+	}
+	if other.ContentDisposition != "" {
+		r.ContentDisposition = other.ContentDisposition
+	}
+	if other.ContentLanguage != "" {
+		r.ContentLanguage = other.ContentLanguage
+	}
+	if other.Expires != "" {
+		r.Expires = other.Expires
+	}
+	if other.Compress != "" {
+		r.Compress = other.Compress
+	}
+	if other.ACL != "" {
+		r.ACL = other.ACL
+	}
+	if other.StorageClass != "" {
+		r.StorageClass = other.StorageClass
+	}
+	if len(other.Tags) > 0 {
+		// the tags are copied so that the rules are never changed
+		tags := make(map[string]string, len(r.Tags)+len(other.Tags))
+		for key, value := range r.Tags {
+			tags[key] = value
+		}
+		for key, value := range other.Tags {
+			tags[key] = value
+		}
+		r.Tags = tags
+	}
+}
+
+// validate returns an error if the rule has no pattern or a property can't be parsed
+func (r *ObjectRule) validate() error {
+	if r.Pattern == "" {
+		return fmt.Errorf("rule without a pattern")
+	}
+	if r.Expires != "" {
+		if _, err := parseExpires(r.Expires, time.Now()); err != nil {
+			return err
+		}
+	}
+	if err := validateACL(r.ACL); err != nil {
+		return err
+	}
+	if err := validateStorageClass(r.StorageClass); err != nil {
+		return err
+	}
+	if err := validateTags(r.Tags); err != nil {
+		return err
+	}
+	return validateCompression(r.Compress)
+}
+
+// headers returns the properties as http headers, to show what will be set on an object
+func (r *ObjectRule) headers() map[string]string {
+	headers := make(map[string]string)
+	for name, value := range map[string]string{
+		"Content-Type":        r.ContentType,
+		"Cache-Control":       r.CacheControl,
+		"Content-Disposition": r.ContentDisposition,
+		"Content-Language":    r.ContentLanguage,
+		"Expires":             r.Expires,
+		"Content-Encoding":    r.Compress,
+		"x-amz-acl":           r.ACL,
+		"x-amz-storage-class": r.StorageClass,
+		"x-amz-tagging":       encodeTags(r.Tags),
+	} {
+		if value != "" {
+			headers[name] = value
+		}
+	}
+	if len(headers) == 0 {
+		return nil
+	}
+	return headers
+}
+
+// copyProperties returns the properties that are set on copied objects, the headers of a copy are kept from the
+// source object
+func (r *ObjectRule) copyProperties() *ObjectRule {
+	return &ObjectRule{Pattern: r.Pattern, ACL: r.ACL, StorageClass: r.StorageClass}
+}
+
+// cannedACLs are the canned ACLs that s3 supports
+var cannedACLs = []string{
+	"private",
+	"public-read",
+	"public-read-write",
+	"authenticated-read",
+	"aws-exec-read",
+	"bucket-owner-read",
+	"bucket-owner-full-control",
+}
+
+// storageClasses are the storage classes that objects can be uploaded with. The vendored sdk only has constants for
+// the first three, but it passes the value on as it is.
+var storageClasses = []string{
+	"STANDARD",
+	"REDUCED_REDUNDANCY",
+	"STANDARD_IA",
+	"ONEZONE_IA",
+	"INTELLIGENT_TIERING",
+	"GLACIER",
+	"GLACIER_IR",
+	"DEEP_ARCHIVE",
+}
+
+// validateACL returns an error if acl isn't empty or a canned ACL
+func validateACL(acl string) error {
+	if acl == "" || contains(cannedACLs, acl) {
+		return nil
+	}
+	return fmt.Errorf("unknown acl '%s', use one of %s", acl, strings.Join(cannedACLs, ", "))
+}
+
+// validateStorageClass returns an error if class isn't empty or a storage class
+func validateStorageClass(class string) error {
+	if class == "" || contains(storageClasses, class) {
+		return nil
+	}
+	return fmt.Errorf("unknown storage class '%s', use one of %s", class, strings.Join(storageClasses, ", "))
+}
+
+// contains returns true if list contains value
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// parseExpires parses an Expires value, either a duration from now like "720h" or a date like
+// "Thu, 01 Dec 2033 16:00:00 GMT" or "2033-12-01T16:00:00Z"
+func parseExpires(value string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(d), nil
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid expires '%s', it should be a duration like 720h or a date", value)
+}
+
+// formatHeaders formats headers sorted by name, like "Cache-Control: no-cache, Content-Type: text/html"
+func formatHeaders(headers map[string]string) string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	formatted := make([]string, len(names))
+	for i, name := range names {
+		formatted[i] = name + ": " + headers[name]
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// ObjectRules are the rules for the properties of uploaded objects. All rules that matches a file are applied in the
+// order they were added, so later rules overrides earlier rules. All methods are safe on a nil ObjectRules.
+type ObjectRules struct {
+	rules []*ObjectRule
+}
+
+// add appends a rule
+func (r *ObjectRules) add(rule *ObjectRule) {
+	r.rules = append(r.rules, rule)
+}
+
+// addDefault inserts a rule before all other rules, so that its properties are used unless another rule overrides them
+func (r *ObjectRules) addDefault(rule *ObjectRule) {
+	r.rules = append([]*ObjectRule{rule}, r.rules...)
+}
+
+// compile compiles the patterns of all rules with the options, it returns an error for the first malformed pattern.
+// Which patterns matches the same files can't be known before the files are listed, so it also returns an error if
+// the rules together have more tag keys than an object can have.
+func (r *ObjectRules) compile(opts globOptions) error {
+	if r == nil {
+		return nil
+	}
+	keys := make(map[string]bool)
+	for _, rule := range r.rules {
+		g, err := compileGlob(rule.Pattern, opts)
+		if err != nil {
+			return err
+		}
+		rule.glob = g
+		for key := range rule.Tags {
+			keys[key] = true
+		}
+	}
+	if len(keys) > maxTags {
+		return fmt.Errorf("the -tag and -tag-rule rules have %d different tag keys together, an object can have at most %d tags", len(keys), maxTags)
+	}
+	return nil
+}
+
+// match returns the properties for the file with the name, from all rules that matches it
+func (r *ObjectRules) match(name string) *ObjectRule {
+	props := &ObjectRule{}
+	if r == nil {
+		return props
+	}
+	for _, rule := range r.rules {
+		if rule.glob.match(name) {
+			props.merge(rule)
+		}
+	}
+	return props
+}
+
+// compresses returns true if any rule compresses files
+func (r *ObjectRules) compresses() bool {
+	if r == nil {
+		return false
+	}
+	for _, rule := range r.rules {
+		if rule.Compress != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// compressed returns true if the file with the name should be compressed when it's uploaded
+func (r *ObjectRules) compressed(file *FileStat) bool {
+	return r.match(file.Name).Compress != ""
+}
+
+// ruleFlag adds a rule to ObjectRules from a flag with the format PATTERN=VALUE, set sets the value on the rule. If
+// implicit is set the value can be left out, e.g. PATTERN, and then implicit is used as the value.
+type ruleFlag struct {
+	rules    *ObjectRules
+	set      func(rule *ObjectRule, value string)
+	implicit string
+}
+
+// String is the method to format the flag's value, part of the flag.Value interface
+func (f *ruleFlag) String() string {
+	return ""
+}
+
+// Set is the method to set the flag value, part of the flag.Value interface. The value is split at the first '=', so
+// values like "text/html; charset=utf-8" can contain a '=' but patterns can't.
+func (f *ruleFlag) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i < 0 && f.implicit != "" {
+		value, i = value+"="+f.implicit, len(value)
+	}
+	if i <= 0 {
+		return fmt.Errorf("'%s' should be PATTERN=VALUE", value)
+	}
+	rule := &ObjectRule{Pattern: value[:i]}
+	f.set(rule, value[i+1:])
+	if err := rule.validate(); err != nil {
+		return err
+	}
+	f.rules.add(rule)
+	return nil
+}
+
+// rulesFileFlag adds the rules in a JSON file to ObjectRules, in the order they are in the file. The file is a list
+// of rules like [{"pattern": "*.html", "cache_control": "no-cache"}].
+type rulesFileFlag struct {
+	rules *ObjectRules
+}
+
+// String is the method to format the flag's value, part of the flag.Value interface
+func (f *rulesFileFlag) String() string {
+	return ""
+}
+
+// Set is the method to set the flag value, part of the flag.Value interface
+func (f *rulesFileFlag) Set(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var rules []*ObjectRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return fmt.Errorf("could not parse %s: %v", path, err)
+	}
+	for i, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("rule %d in %s: %v", i+1, path, err)
+		}
+	}
+	for _, rule := range rules {
+		f.rules.add(rule)
+	}
+	return nil
+}
+
+// setObjectHeaders sets the headers from the rule properties on the upload, the Expires of a duration is from now
+func setObjectHeaders(params *s3manager.UploadInput, props *ObjectRule, now time.Time) {
+	if props.CacheControl != "" {
+		params.CacheControl = aws.String(props.CacheControl)
+	}
+	if props.ContentDisposition != "" {
+		params.ContentDisposition = aws.String(props.ContentDisposition)
+	}
+	if props.ContentLanguage != "" {
+		params.ContentLanguage = aws.String(props.ContentLanguage)
+	}
+	if props.Expires != "" {
+		// the rules are validated when they are added, so this can't fail
+		if expires, err := parseExpires(props.Expires, now); err == nil {
+			params.Expires = aws.Time(expires)
+		}
+	}
+	if props.ACL != "" {
+		params.ACL = aws.String(props.ACL)
+	}
+	if props.StorageClass != "" {
+		params.StorageClass = aws.String(props.StorageClass)
+	}
+	if len(props.Tags) > 0 {
+		params.Tagging = aws.String(encodeTags(props.Tags))
+	}
+}
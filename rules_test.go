@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+func TestObjectRules(t *testing.T) {
+	rules := &ObjectRules{}
+	flag := &ruleFlag{rules: rules, set: func(rule *ObjectRule, value string) { rule.ContentType = value }}
+	for _, value := range []string{"*.rss=application/rss+xml", "feeds/*=text/xml; charset=utf-8", "feeds/atom.rss=application/atom+xml"} {
+		if err := flag.Set(value); err != nil {
+			t.Fatalf("Set(%q) failed: %v", value, err)
+		}
+	}
+	if err := flag.Set("no-value"); err == nil {
+		t.Error("expected an error for a rule without '='")
+	}
+	if err := rules.compile(globOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{name: "index.html", expected: ""},
+		{name: "news.rss", expected: "application/rss+xml"},
+		{name: "feeds/news.rss", expected: "text/xml; charset=utf-8"},
+		{name: "feeds/atom.rss", expected: "application/atom+xml"},
+	}
+	for _, test := range tests {
+		if actual := rules.match(test.name).ContentType; actual != test.expected {
+			t.Errorf("match(%q).ContentType => %q, want %q", test.name, actual, test.expected)
+		}
+	}
+
+	var none *ObjectRules
+	if none.match("index.html") == nil {
+		t.Error("expected empty properties from nil rules")
+	}
+}
+
+func TestObjectRuleHeaders(t *testing.T) {
+	rules := &ObjectRules{}
+	file, err := ioutil.TempFile("", "s3sync-rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Remove(file.Name())
+	}()
+	_, _ = file.WriteString(`[
+		{"pattern": "*", "cache_control": "max-age=31536000, immutable"},
+		{"pattern": "*.html", "cache_control": "no-cache", "content_language": "en-NZ"},
+		{"pattern": "downloads/*", "content_disposition": "attachment", "expires": "24h"}
+	]`)
+	_ = file.Close()
+	if err := (&rulesFileFlag{rules}).Set(file.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&ruleFlag{rules: rules, set: func(r *ObjectRule, v string) { r.ContentLanguage = v }}).Set("de/*=de-DE"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rules.compile(globOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	params := &s3manager.UploadInput{}
+	setObjectHeaders(params, rules.match("de/index.html"), now)
+	if aws.StringValue(params.CacheControl) != "no-cache" || aws.StringValue(params.ContentLanguage) != "de-DE" ||
+		params.ContentDisposition != nil || params.Expires != nil {
+		t.Errorf("unexpected headers for de/index.html: %s", awsutil.Prettify(params))
+	}
+
+	params = &s3manager.UploadInput{}
+	setObjectHeaders(params, rules.match("downloads/report.pdf"), now)
+	if aws.StringValue(params.CacheControl) != "max-age=31536000, immutable" ||
+		aws.StringValue(params.ContentDisposition) != "attachment" || !aws.TimeValue(params.Expires).Equal(now.Add(24*time.Hour)) {
+		t.Errorf("unexpected headers for downloads/report.pdf: %s", awsutil.Prettify(params))
+	}
+
+	headers := formatHeaders(rules.match("downloads/index.html").headers())
+	expected := "Cache-Control: no-cache, Content-Disposition: attachment, Content-Language: en-NZ, Expires: 24h"
+	if headers != expected {
+		t.Errorf("headers are %q, want %q", headers, expected)
+	}
+	if rules.match("nothing").headers() == nil {
+		t.Error("expected the catch all rule to set headers")
+	}
+}
+
+func TestObjectRuleACLAndStorageClass(t *testing.T) {
+	rules := &ObjectRules{}
+	aclFlag := &ruleFlag{rules: rules, set: func(r *ObjectRule, v string) { r.ACL = v }}
+	classFlag := &ruleFlag{rules: rules, set: func(r *ObjectRule, v string) { r.StorageClass = v }}
+	if err := aclFlag.Set("public/**=public-read"); err != nil {
+		t.Fatal(err)
+	}
+	if err := classFlag.Set("archive/**=GLACIER_IR"); err != nil {
+		t.Fatal(err)
+	}
+	if err := aclFlag.Set("*=public"); err == nil {
+		t.Error("expected an error for an unknown acl")
+	}
+	if err := classFlag.Set("*=standard_ia"); err == nil {
+		t.Error("expected an error for an unknown storage class")
+	}
+	// the default is added after the rules for patterns, but they still override it
+	rules.addDefault(&ObjectRule{Pattern: "**", ACL: "bucket-owner-full-control", StorageClass: "INTELLIGENT_TIERING"})
+	if err := rules.compile(globOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	params := &s3manager.UploadInput{}
+	setObjectHeaders(params, rules.match("public/css/site.css"), time.Now())
+	if aws.StringValue(params.ACL) != "public-read" || aws.StringValue(params.StorageClass) != "INTELLIGENT_TIERING" {
+		t.Errorf("unexpected acl and storage class for public/css/site.css: %s", awsutil.Prettify(params))
+	}
+
+	headers := formatHeaders(rules.match("archive/2019.tar").copyProperties().headers())
+	expected := "x-amz-acl: bucket-owner-full-control, x-amz-storage-class: GLACIER_IR"
+	if headers != expected {
+		t.Errorf("headers are %q, want %q", headers, expected)
+	}
+}
+
+func TestParseExpires(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		in       string
+		expected time.Time
+		err      bool
+	}{
+		{in: "720h", expected: now.Add(720 * time.Hour)},
+		{in: "Thu, 01 Dec 2033 16:00:00 GMT", expected: time.Date(2033, 12, 1, 16, 0, 0, 0, time.UTC)},
+		{in: "2033-12-01T16:00:00Z", expected: time.Date(2033, 12, 1, 16, 0, 0, 0, time.UTC)},
+		{in: "tomorrow", err: true},
+	}
+	for _, test := range tests {
+		actual, err := parseExpires(test.in, now)
+		if test.err != (err != nil) {
+			t.Errorf("parseExpires(%q) gave error %v", test.in, err)
+			continue
+		}
+		if !actual.Equal(test.expected) {
+			t.Errorf("parseExpires(%q) => %s, want %s", test.in, actual, test.expected)
+		}
+	}
+	if err := (&ruleFlag{rules: &ObjectRules{}, set: func(r *ObjectRule, v string) { r.Expires = v }}).Set("*=tomorrow"); err == nil {
+		t.Error("expected an error for an invalid -expires-rule")
+	}
+}
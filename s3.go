@@ -23,9 +23,14 @@ func loadS3Files(conf *Config, buffer int, logger *Logger) chan *FileStat {
 }
 
 func listS3Files(config *Config, out chan *FileStat, token *string) *string {
+	// the prefix is a directory, without the slash objects in sibling directories like www2/ would be listed as well
+	prefix := config.BucketPrefix
+	if prefix != "" {
+		prefix += "/"
+	}
 	list, err := config.S3Service.ListObjectsV2(&s3.ListObjectsV2Input{
 		Bucket:            aws.String(config.Bucket),
-		Prefix:            aws.String(config.BucketPrefix),
+		Prefix:            aws.String(prefix),
 		ContinuationToken: token,
 	})
 	if err != nil {
@@ -33,11 +38,21 @@ func listS3Files(config *Config, out chan *FileStat, token *string) *string {
 		return nil
 	}
 	for _, object := range list.Contents {
+		// objects ending with a slash are 'folders' created by the s3 console, they are not files
+		if strings.HasSuffix(*object.Key, "/") {
+			continue
+		}
+		// objects that are excluded are left out, so they are never overwritten or deleted
+		name := strings.TrimPrefix(*object.Key, prefix)
+		if config.Filter.excluded(name) {
+			continue
+		}
 		out <- &FileStat{
-			Name:    strings.TrimPrefix(*object.Key, config.BucketPrefix+"/"),
+			Name:    name,
 			Path:    *object.Key,
 			Size:    *object.Size,
 			ModTime: *object.LastModified,
+			ETag:    strings.Trim(aws.StringValue(object.ETag), `"`),
 		}
 	}
 	return list.NextContinuationToken
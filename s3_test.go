@@ -0,0 +1,57 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// listMock lists the keys that starts with the prefix, like s3 does, two keys at a time
+type listMock struct {
+	s3iface.S3API
+	keys []string
+}
+
+func (m *listMock) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	out := &s3.ListObjectsV2Output{}
+	for _, key := range m.keys {
+		if !strings.HasPrefix(key, aws.StringValue(input.Prefix)) || key <= aws.StringValue(input.ContinuationToken) {
+			continue
+		}
+		if len(out.Contents) == 2 {
+			out.NextContinuationToken = out.Contents[1].Key
+			break
+		}
+		out.Contents = append(out.Contents, &s3.Object{Key: aws.String(key), Size: aws.Int64(1), LastModified: aws.Time(time.Now())})
+	}
+	return out, nil
+}
+
+func TestLoadS3FilesSiblingPrefix(t *testing.T) {
+	logger, _ := getTestLogger()
+	mock := &listMock{keys: []string{"index.html", "www/a.css", "www/b.css", "www/css/c.css", "www2/a.css", "wwwold.html"}}
+
+	tests := map[string][]string{
+		"www": {"a.css", "b.css", "css/c.css"},
+		"":    {"index.html", "www/a.css", "www/b.css", "www/css/c.css", "www2/a.css", "wwwold.html"},
+	}
+	for prefix, expected := range tests {
+		config := &Config{S3Service: mock, Bucket: "bucket", BucketPrefix: prefix}
+		var names []string
+		for file := range loadS3Files(config, 10, logger) {
+			if file.Err != nil {
+				t.Fatal(file.Err)
+			}
+			names = append(names, file.Name)
+		}
+		sort.Strings(names)
+		if strings.Join(names, ",") != strings.Join(expected, ",") {
+			t.Errorf("prefix '%s': expected %v, got %v", prefix, expected, names)
+		}
+	}
+}
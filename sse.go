@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// The server side encryption methods, and the algorithm of customer provided keys
+const (
+	sseS3        = "AES256"
+	sseKMS       = "aws:kms"
+	sseAlgorithm = "AES256"
+)
+
+// customerKeySize is the size of customer provided keys, they are 256 bit AES keys
+const customerKeySize = 32
+
+// Encryption is the server side encryption of objects. All methods are safe on a nil Encryption, which leaves the
+// encryption to the default of the bucket.
+type Encryption struct {
+	// Method is "AES256" for keys managed by s3 or "aws:kms" for keys in KMS, empty when a customer key is used
+	Method string
+	// KMSKeyID is the KMS key used when Method is "aws:kms", empty for the aws managed key
+	KMSKeyID string
+	// CustomerKey is the raw key of SSE-C, where s3 encrypts the objects with a key that we send with every request
+	CustomerKey string
+}
+
+// newEncryption returns the Encryption for the command line flags, or nil if no encryption is set. customerKey is the
+// raw or base64 encoded key, or file://path to read it from a file.
+func newEncryption(method, kmsKeyID string, customer bool, customerKey string) (*Encryption, error) {
+	if method == "" && kmsKeyID == "" && !customer && customerKey == "" {
+		return nil, nil
+	}
+	switch {
+	case method != "" && method != sseS3 && method != sseKMS:
+		return nil, fmt.Errorf("-sse must be %s or %s, not '%s'", sseS3, sseKMS, method)
+	case kmsKeyID != "" && method != sseKMS:
+		return nil, fmt.Errorf("-sse-kms-key-id requires -sse %s", sseKMS)
+	case customer && method != "":
+		return nil, errors.New("-sse and -sse-c can't be used together")
+	case customer && customerKey == "":
+		return nil, errors.New("-sse-c requires -sse-c-key")
+	case !customer && customerKey != "":
+		return nil, errors.New("-sse-c-key requires -sse-c")
+	}
+	e := &Encryption{Method: method, KMSKeyID: kmsKeyID}
+	if customer {
+		key, err := parseCustomerKey(customerKey)
+		if err != nil {
+			return nil, err
+		}
+		e.CustomerKey = key
+	}
+	return e, nil
+}
+
+// parseCustomerKey returns the raw key from a value that is the raw 32 bytes, the base64 encoded bytes or file://path
+// to a file with the key in one of those forms
+func parseCustomerKey(value string) (string, error) {
+	if strings.HasPrefix(value, "file://") {
+		data, err := ioutil.ReadFile(strings.TrimPrefix(value, "file://"))
+		if err != nil {
+			return "", err
+		}
+		value = string(data)
+		// a base64 encoded key in a file usually ends with a newline, a raw key can contain any bytes
+		if len(value) != customerKeySize {
+			value = strings.TrimSpace(value)
+		}
+	}
+	if len(value) == customerKeySize {
+		return value, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(value); err == nil && len(key) == customerKeySize {
+		return string(key), nil
+	}
+	return "", fmt.Errorf("the customer key must be %d bytes, or %d bytes base64 encoded", customerKeySize, customerKeySize)
+}
+
+// opaqueETags returns true if the ETags of the encrypted objects aren't the md5 of their content, which is the case
+// for KMS and customer provided keys
+func (e *Encryption) opaqueETags() bool {
+	return e != nil && (e.Method == sseKMS || e.CustomerKey != "")
+}
+
+// customerKey returns the algorithm and key for the SSE-C headers, or nils if there is no customer key. The sdk base64
+// encodes the key and adds its md5.
+func (e *Encryption) customerKey() (*string, *string) {
+	if e == nil || e.CustomerKey == "" {
+		return nil, nil
+	}
+	return aws.String(sseAlgorithm), aws.String(e.CustomerKey)
+}
+
+// method returns the server side encryption and KMS key, or nils if they aren't set
+func (e *Encryption) method() (*string, *string) {
+	if e == nil || e.Method == "" {
+		return nil, nil
+	}
+	if e.KMSKeyID == "" {
+		return aws.String(e.Method), nil
+	}
+	return aws.String(e.Method), aws.String(e.KMSKeyID)
+}
+
+// setUpload sets the encryption of an upload, multipart uploads copies the headers to each part
+func (e *Encryption) setUpload(params *s3manager.UploadInput) {
+	params.ServerSideEncryption, params.SSEKMSKeyId = e.method()
+	params.SSECustomerAlgorithm, params.SSECustomerKey = e.customerKey()
+}
+
+// setHead sets the customer key that is needed to read the headers of an object encrypted with it
+func (e *Encryption) setHead(input *s3.HeadObjectInput) {
+	input.SSECustomerAlgorithm, input.SSECustomerKey = e.customerKey()
+}
+
+// setGet sets the customer key that is needed to download an object encrypted with it
+func (e *Encryption) setGet(input *s3.GetObjectInput) {
+	input.SSECustomerAlgorithm, input.SSECustomerKey = e.customerKey()
+}
+
+// setCopy sets the encryption of a copied object, and the customer key of the source object
+func (e *Encryption) setCopy(input *s3.CopyObjectInput, source *Encryption) {
+	input.ServerSideEncryption, input.SSEKMSKeyId = e.method()
+	input.SSECustomerAlgorithm, input.SSECustomerKey = e.customerKey()
+	input.CopySourceSSECustomerAlgorithm, input.CopySourceSSECustomerKey = source.customerKey()
+}
+
+// setCreateMultipart sets the encryption of a multipart upload
+func (e *Encryption) setCreateMultipart(input *s3.CreateMultipartUploadInput) {
+	input.ServerSideEncryption, input.SSEKMSKeyId = e.method()
+	input.SSECustomerAlgorithm, input.SSECustomerKey = e.customerKey()
+}
+
+// setUploadPartCopy sets the customer keys of a part that is copied, the rest of the encryption is set when the
+// multipart upload is created
+func (e *Encryption) setUploadPartCopy(input *s3.UploadPartCopyInput, source *Encryption) {
+	input.SSECustomerAlgorithm, input.SSECustomerKey = e.customerKey()
+	input.CopySourceSSECustomerAlgorithm, input.CopySourceSSECustomerKey = source.customerKey()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+func TestNewEncryption(t *testing.T) {
+	key := strings.Repeat("k", customerKeySize)
+	tests := []struct {
+		method, kmsKeyID string
+		customer         bool
+		customerKey      string
+		valid            bool
+	}{
+		{valid: true},
+		{method: "AES256", valid: true},
+		{method: "aws:kms", kmsKeyID: "alias/s3sync", valid: true},
+		{method: "aes256"},
+		{kmsKeyID: "alias/s3sync"},
+		{method: "AES256", kmsKeyID: "alias/s3sync"},
+		{customer: true, customerKey: key, valid: true},
+		{customer: true, customerKey: base64.StdEncoding.EncodeToString([]byte(key)), valid: true},
+		{customer: true, customerKey: "too short"},
+		{customer: true},
+		{customerKey: key},
+		{method: "AES256", customer: true, customerKey: key},
+	}
+	for _, test := range tests {
+		_, err := newEncryption(test.method, test.kmsKeyID, test.customer, test.customerKey)
+		if (err == nil) != test.valid {
+			t.Errorf("newEncryption(%q, %q, %t, %q) => %v, want valid %t", test.method, test.kmsKeyID, test.customer, test.customerKey, err, test.valid)
+		}
+	}
+
+	if e, _ := newEncryption("", "", false, ""); e != nil {
+		t.Errorf("expected no encryption without flags, got %+v", e)
+	}
+}
+
+func TestParseCustomerKeyFile(t *testing.T) {
+	key := strings.Repeat("k", customerKeySize)
+	file, err := ioutil.TempFile("", "s3sync-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Remove(file.Name())
+	}()
+	_, _ = file.WriteString(base64.StdEncoding.EncodeToString([]byte(key)) + "\n")
+	_ = file.Close()
+
+	actual, err := parseCustomerKey("file://" + file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual != key {
+		t.Errorf("parseCustomerKey => %q, want %q", actual, key)
+	}
+}
+
+func TestEncryptionInputs(t *testing.T) {
+	kms := &Encryption{Method: sseKMS, KMSKeyID: "alias/s3sync"}
+	customer := &Encryption{CustomerKey: strings.Repeat("k", customerKeySize)}
+	source := &Encryption{CustomerKey: strings.Repeat("s", customerKeySize)}
+
+	params := &s3manager.UploadInput{}
+	kms.setUpload(params)
+	if aws.StringValue(params.ServerSideEncryption) != sseKMS || aws.StringValue(params.SSEKMSKeyId) != "alias/s3sync" || params.SSECustomerKey != nil {
+		t.Errorf("unexpected encryption of upload: %s", awsutil.Prettify(params))
+	}
+
+	copyInput := &s3.CopyObjectInput{}
+	customer.setCopy(copyInput, source)
+	if copyInput.ServerSideEncryption != nil || aws.StringValue(copyInput.SSECustomerKey) != customer.CustomerKey ||
+		aws.StringValue(copyInput.CopySourceSSECustomerKey) != source.CustomerKey || aws.StringValue(copyInput.CopySourceSSECustomerAlgorithm) != sseAlgorithm {
+		t.Errorf("unexpected encryption of copy: %s", awsutil.Prettify(copyInput))
+	}
+
+	var none *Encryption
+	head := &s3.HeadObjectInput{}
+	none.setHead(head)
+	if head.SSECustomerKey != nil || none.opaqueETags() {
+		t.Error("expected no encryption from a nil Encryption")
+	}
+	if !kms.opaqueETags() || !customer.opaqueETags() || (&Encryption{Method: sseS3}).opaqueETags() {
+		t.Error("expected only kms and customer keys to have opaque ETags")
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SyncStrategy decides if a source file should be synced to the destination. dest is nil when the file doesn't exist
+// in the destination. The reason describes why the file will be synced or skipped and is used for logging.
+type SyncStrategy interface {
+	ShouldSync(source, dest *FileStat) (sync bool, reason string)
+}
+
+// strategyOptions are the command line flags that select the SyncStrategy
+type strategyOptions struct {
+	SizeOnly        bool
+	ExactTimestamps bool
+	Checksum        bool
+	IgnoreExisting  bool
+	Existing        bool
+	// PartSize is the part size used for multipart uploads, needed to calculate multipart ETags
+	PartSize int64
+	// OpaqueETags is true when objects are encrypted in a way that makes their ETags something else than the md5 of the
+	// content
+	OpaqueETags bool
+	// Keys are the keys of client side encryption, the checksums of encrypted objects are only known with them
+	Keys KeyWrapper
+}
+
+// newSyncStrategy returns the SyncStrategy for the combination of command line flags
+func newSyncStrategy(opts strategyOptions) (SyncStrategy, error) {
+	exclusive := 0
+	for _, set := range []bool{opts.SizeOnly, opts.ExactTimestamps, opts.Checksum} {
+		if set {
+			exclusive++
+		}
+	}
+	if exclusive > 1 {
+		return nil, errors.New("only one of -size-only, -exact-timestamps and -checksum can be used")
+	}
+	if opts.IgnoreExisting && opts.Existing {
+		return nil, errors.New("-ignore-existing and -existing can't be used together, nothing would be synced")
+	}
+
+	var strategy SyncStrategy = defaultStrategy{}
+	switch {
+	case opts.SizeOnly:
+		strategy = sizeOnlyStrategy{}
+	case opts.ExactTimestamps:
+		strategy = exactTimestampsStrategy{}
+	case opts.Checksum:
+		strategy = checksumStrategy{partSize: opts.PartSize, opaqueETags: opts.OpaqueETags, keys: opts.Keys}
+	}
+	if opts.IgnoreExisting {
+		strategy = ignoreExistingStrategy{}
+	}
+	if opts.Existing {
+		strategy = existingStrategy{next: strategy}
+	}
+	return strategy, nil
+}
+
+// defaultStrategy syncs a file if the size is different or the source file is newer than the destination file.
+// This is the same logic as the aws s3 sync tool uses, see https://github.com/aws/aws-cli/blob/e2295b022db35eea9fec7e6c5540d06dbd6e588b/awscli/customizations/s3/syncstrategy/base.py#L226
+type defaultStrategy struct{}
+
+func (defaultStrategy) ShouldSync(source, dest *FileStat) (bool, string) {
+	if dest == nil {
+		return true, "file does not exist at destination"
+	}
+	if source.Size != dest.Size {
+		return true, fmt.Sprintf("size %d -> %d", source.Size, dest.Size)
+	}
+	if source.ModTime.After(dest.ModTime) {
+		return true, fmt.Sprintf("modified time: %s -> %s", source.ModTime, dest.ModTime.In(source.ModTime.Location()))
+	}
+	return false, "same size and destination is newer"
+}
+
+// sizeOnlyStrategy syncs a file if the size is different and ignores the modified times
+type sizeOnlyStrategy struct{}
+
+func (sizeOnlyStrategy) ShouldSync(source, dest *FileStat) (bool, string) {
+	if dest == nil {
+		return true, "file does not exist at destination"
+	}
+	if source.Size != dest.Size {
+		return true, fmt.Sprintf("size %d -> %d", source.Size, dest.Size)
+	}
+	return false, "same size"
+}
+
+// exactTimestampsStrategy syncs a file if the size is different or the modified times are not exactly the same, even
+// if the destination is newer. Times are compared with second precision since that is all s3 keeps.
+type exactTimestampsStrategy struct{}
+
+func (exactTimestampsStrategy) ShouldSync(source, dest *FileStat) (bool, string) {
+	if dest == nil {
+		return true, "file does not exist at destination"
+	}
+	if source.Size != dest.Size {
+		return true, fmt.Sprintf("size %d -> %d", source.Size, dest.Size)
+	}
+	if !source.ModTime.Truncate(time.Second).Equal(dest.ModTime.Truncate(time.Second)) {
+		return true, fmt.Sprintf("modified time: %s -> %s", source.ModTime, dest.ModTime.In(source.ModTime.Location()))
+	}
+	return false, "same size and modified time"
+}
+
+// ignoreExistingStrategy only syncs files that doesn't exist in the destination, it never overwrites anything
+type ignoreExistingStrategy struct{}
+
+func (ignoreExistingStrategy) ShouldSync(source, dest *FileStat) (bool, string) {
+	if dest == nil {
+		return true, "file does not exist at destination"
+	}
+	return false, "file exists at destination"
+}
+
+// existingStrategy only updates files that already exist in the destination, next decides if they should be updated
+type existingStrategy struct {
+	next SyncStrategy
+}
+
+func (s existingStrategy) ShouldSync(source, dest *FileStat) (bool, string) {
+	if dest == nil {
+		return false, "file does not exist at destination"
+	}
+	return s.next.ShouldSync(source, dest)
+}
@@ -2,9 +2,13 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
@@ -15,32 +19,110 @@ type Logger struct {
 	Out   *log.Logger
 	Err   *log.Logger
 	Debug *log.Logger
+	// Events receives all events and log lines when the output is JSON, when it's nil events are printed as text
+	Events EventSink
+
+	// the writers of the loggers are kept so they can be wrapped, log.Logger can't return them before go 1.12
+	out, err, debug io.Writer
 }
 
-// NewLogger creates a new Logger ready for use
-func NewLogger(debug, onlyShowErrors bool) *Logger {
-	l := &Logger{
-		Out:   log.New(os.Stdout, "", 0),
-		Err:   log.New(os.Stderr, "", 0),
-		Debug: log.New(os.Stdout, "[DEBUG] ", 0),
+// NewLogger creates a new Logger ready for use, if jsonOutput is true everything is written as JSON Lines to stdout
+func NewLogger(debug, onlyShowErrors, jsonOutput bool) *Logger {
+	l := &Logger{out: os.Stdout, err: os.Stderr, debug: os.Stdout}
+	debugPrefix := "[DEBUG] "
+	if jsonOutput {
+		l.Events = newJSONSink(os.Stdout, onlyShowErrors)
+		l.out = &sinkWriter{sink: l.Events, level: "info"}
+		l.err = &sinkWriter{sink: l.Events, level: "error"}
+		l.debug = &sinkWriter{sink: l.Events, level: "debug"}
+		debugPrefix = ""
 	}
 	if !debug {
-		l.Debug.SetOutput(ioutil.Discard)
+		l.debug = ioutil.Discard
 	}
 
 	if onlyShowErrors {
-		l.Debug.SetOutput(ioutil.Discard)
-		l.Out.SetOutput(ioutil.Discard)
+		l.debug = ioutil.Discard
+		l.out = ioutil.Discard
 	}
+	l.Out = log.New(l.out, "", 0)
+	l.Err = log.New(l.err, "", 0)
+	l.Debug = log.New(l.debug, debugPrefix, 0)
 	return l
 }
 
+// wrapOutput replaces the writers of the loggers with the writers that wrap returns for them
+func (l *Logger) wrapOutput(wrap func(io.Writer) io.Writer) {
+	l.out, l.err, l.debug = wrap(l.out), wrap(l.err), wrap(l.debug)
+	l.Out.SetOutput(l.out)
+	l.Err.SetOutput(l.err)
+	l.Debug.SetOutput(l.debug)
+}
+
+// SyncMode describes in which direction files are synced
+type SyncMode int
+
+const (
+	// Upload syncs a local directory to a bucket
+	Upload SyncMode = iota
+	// Download syncs a bucket to a local directory
+	Download
+	// Copy syncs a bucket to another bucket with server side copies
+	Copy
+)
+
+func (m SyncMode) String() string {
+	switch m {
+	case Download:
+		return EventDownload
+	case Copy:
+		return EventCopy
+	}
+	return EventUpload
+}
+
 // Config contains common paths and configuration
 type Config struct {
 	S3Service    s3iface.S3API
 	Bucket       string
 	BucketPrefix string
+	LocalPath    string
+	Mode         SyncMode
 	DryRun       bool
+	Strategy     SyncStrategy
+	Cache        *StateCache
+	// Concurrency is the number of files that are transferred at the same time
+	Concurrency int
+	// PartSize is the size of each part in multipart uploads and ranged downloads
+	PartSize int64
+	// PartConcurrency is the number of parts of one file that are transferred at the same time
+	PartConcurrency int
+	// MultipartThreshold is the file size from which files are uploaded with multipart uploads
+	MultipartThreshold int64
+	// Summary collects the results of the run
+	Summary *Summary
+	// Progress tracks the transfers while they happen, it's nil unless progress reporting is turned on
+	Progress *Progress
+	// Retry decides if and when failed transfers are retried
+	Retry *RetryPolicy
+	// Filter decides which files and objects that are part of the sync, both in the source and the destination
+	Filter *Filter
+	// MimeTypes are the content types of uploaded files by their extension
+	MimeTypes MimeTypes
+	// Rules sets properties of uploaded objects by patterns
+	Rules *ObjectRules
+	// Encryption is the server side encryption of objects, nil for the default encryption of the bucket
+	Encryption *Encryption
+	// ClientEncryption encrypts files before they are uploaded, nil if they are uploaded as they are
+	ClientEncryption KeyWrapper
+	// Preserve is the attributes of files that are stored in the metadata of objects, nil if none are
+	Preserve *Preserve
+	// Symlinks decides how symbolic links in the local directory are synced
+	Symlinks SymlinkPolicy
+	// Journal records the transfers so an interrupted sync can be resumed, nil if there is no journal
+	Journal *Journal
+	// Source is the bucket that objects are copied from when Mode is Copy
+	Source *Config
 }
 
 // A FileStat describes a local and remote file and can contain an error if the information
@@ -51,6 +133,21 @@ type FileStat struct {
 	Path    string
 	Size    int64
 	ModTime time.Time
+	// ETag is the ETag of s3 objects without the surrounding quotes, it's empty for local files
+	ETag string
+	// Inode is the inode number of local files, used to detect if a file has been replaced
+	Inode uint64
+	// Checksum is the calculated ETag of local files, empty until it's been calculated or found in the StateCache
+	Checksum string
+	// ChecksumPartSize is the part size the Checksum was calculated with, 0 for a plain md5
+	ChecksumPartSize int64
+	// RemoteETag is the ETag of the s3 object that the Checksum was calculated to compare with
+	RemoteETag string
+	// ContentEncoding and Metadata are the headers of remote files, only set for files that needed a HeadObject call
+	ContentEncoding string
+	Metadata        map[string]string
+	// LinkTarget is the target of local symbolic links that are synced as links
+	LinkTarget string
 }
 
 func (f *FileStat) String() string {
@@ -75,3 +172,44 @@ func (s *StringSlice) Set(value string) error {
 	*s = append(*s, value)
 	return nil
 }
+
+// ByteSize is usable for flags that are a size in bytes, the value can have a unit, example: -part-size 16MB
+type ByteSize int64
+
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"GIB", 1 << 30}, {"TIB", 1 << 40},
+	{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"TB", 1 << 40},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+	{"B", 1},
+}
+
+// String is the method to format the flag's value, part of the flag.Value interface.
+func (b *ByteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+// Set is the method to set the flag value, part of the flag.Value interface. Units are powers of 1024 like the aws cli
+// uses them, so both 8MB and 8MiB is 8388608 bytes.
+func (b *ByteSize) Set(value string) error {
+	number := strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(number, unit.suffix) {
+			number = strings.TrimSpace(strings.TrimSuffix(number, unit.suffix))
+			multiplier = unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size '%s'", value)
+	}
+	if n > math.MaxInt64/multiplier {
+		return fmt.Errorf("size '%s' is too large", value)
+	}
+	*b = ByteSize(n * multiplier)
+	return nil
+}
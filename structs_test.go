@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestByteSize(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected int64
+		err      bool
+	}{
+		{in: "0", expected: 0},
+		{in: "1024", expected: 1024},
+		{in: "10B", expected: 10},
+		{in: "8KB", expected: 8 * 1024},
+		{in: "8MB", expected: 8 * 1024 * 1024},
+		{in: "8MiB", expected: 8 * 1024 * 1024},
+		{in: "8mb", expected: 8 * 1024 * 1024},
+		{in: "8 MB", expected: 8 * 1024 * 1024},
+		{in: "1G", expected: 1024 * 1024 * 1024},
+		{in: "2TB", expected: 2 * 1024 * 1024 * 1024 * 1024},
+		{in: "", err: true},
+		{in: "MB", err: true},
+		{in: "1.5MB", err: true},
+		{in: "-1MB", err: true},
+		{in: "8388608TB", err: true},
+		{in: "9223372036854775807", expected: 9223372036854775807},
+	}
+	for _, test := range tests {
+		var b ByteSize
+		err := b.Set(test.in)
+		if test.err {
+			if err == nil {
+				t.Errorf("ByteSize.Set(%q) expected an error, got %d", test.in, b)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ByteSize.Set(%q) returned unexpected error %v", test.in, err)
+			continue
+		}
+		if int64(b) != test.expected {
+			t.Errorf("ByteSize.Set(%q) => %d, want %d", test.in, b, test.expected)
+		}
+	}
+}
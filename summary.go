@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Exit codes, so that scripts can tell what went wrong
+const (
+	// exitOK means that everything that should be synced was synced
+	exitOK = 0
+	// exitTransferFailed means that one or more files failed to transfer or delete, the rest was synced
+	exitTransferFailed = 1
+	// exitConfigError means that the arguments, flags or credentials were wrong and nothing was synced
+	exitConfigError = 2
+	// exitListingError means that not all source or destination files could be listed, so some files might not have
+	// been synced
+	exitListingError = 3
+)
+
+// Result is the outcome of transferring one file
+type Result struct {
+	File     *FileStat
+	Err      error
+	Duration time.Duration
+	// Attempts is how many times the transfer was tried
+	Attempts int
+}
+
+// Summary collects the results of a sync run. All methods are safe for concurrent use, and are no-ops on a nil
+// Summary so that code under test doesn't need one.
+type Summary struct {
+	mu            sync.Mutex
+	start         time.Time
+	transferred   int
+	skipped       int
+	failed        int
+	deleted       int
+	retried       int
+	bytes         int64
+	listingErrors int
+}
+
+// NewSummary creates a new Summary and starts the clock for the run
+func NewSummary() *Summary {
+	return &Summary{start: time.Now()}
+}
+
+// add records the result of a file transfer
+func (s *Summary) add(result *Result) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if result.Attempts > 1 {
+		s.retried++
+	}
+	if result.Err != nil {
+		s.failed++
+		return
+	}
+	s.transferred++
+	s.bytes += result.File.Size
+}
+
+// skip records a file that didn't need to be synced
+func (s *Summary) skip() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.skipped++
+	s.mu.Unlock()
+}
+
+// deleteResult records a file that was deleted, or failed to be deleted, from the destination
+func (s *Summary) deleteResult(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.failed++
+		return
+	}
+	s.deleted++
+}
+
+// listingError records that a source or destination file couldn't be listed
+func (s *Summary) listingError() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.listingErrors++
+	s.mu.Unlock()
+}
+
+// success returns true if nothing has failed so far
+func (s *Summary) success() bool {
+	return s.exitCode() == exitOK
+}
+
+// exitCode returns the exit code for the results, listing errors are more serious than transfer failures since we
+// don't know what files that might have been missed.
+func (s *Summary) exitCode() int {
+	if s == nil {
+		return exitOK
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listingErrors > 0 {
+		return exitListingError
+	}
+	if s.failed > 0 {
+		return exitTransferFailed
+	}
+	return exitOK
+}
+
+// SummaryCounts are the numbers of the summary, used in the JSON output
+type SummaryCounts struct {
+	Transferred   int   `json:"transferred"`
+	Skipped       int   `json:"skipped"`
+	Failed        int   `json:"failed"`
+	Deleted       int   `json:"deleted"`
+	Retried       int   `json:"retried"`
+	ListingErrors int   `json:"listing_errors"`
+	Bytes         int64 `json:"bytes"`
+}
+
+// event returns the summary as an event, verb is what happened to the transferred files, e.g. "uploaded"
+func (s *Summary) event(verb string, dryRun bool) *Event {
+	msg := s.String(verb)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &Event{
+		Type:     EventSummary,
+		DryRun:   dryRun,
+		Message:  msg,
+		Size:     s.bytes,
+		Duration: time.Since(s.start).Seconds(),
+		Summary: &SummaryCounts{
+			Transferred:   s.transferred,
+			Skipped:       s.skipped,
+			Failed:        s.failed,
+			Deleted:       s.deleted,
+			Retried:       s.retried,
+			ListingErrors: s.listingErrors,
+			Bytes:         s.bytes,
+		},
+	}
+}
+
+// String formats the summary, verb is what happened to the transferred files, e.g. "uploaded"
+func (s *Summary) String(verb string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msg := fmt.Sprintf("%s %d, skipped %d, failed %d", verb, s.transferred, s.skipped, s.failed)
+	if s.deleted > 0 {
+		msg += fmt.Sprintf(", deleted %d", s.deleted)
+	}
+	if s.retried > 0 {
+		msg += fmt.Sprintf(", retried %d", s.retried)
+	}
+	if s.listingErrors > 0 {
+		msg += fmt.Sprintf(", listing errors %d", s.listingErrors)
+	}
+	return fmt.Sprintf("%s, %s in %s", msg, formatBytes(s.bytes), time.Since(s.start).Round(time.Millisecond))
+}
+
+// formatBytes formats a number of bytes with a unit, e.g. 1.5 MiB
+func formatBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
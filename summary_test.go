@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSummary(t *testing.T) {
+	summary := NewSummary()
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			if i%10 == 0 {
+				err = errors.New("failed")
+			}
+			summary.add(&Result{File: &FileStat{Size: 10}, Err: err})
+			summary.skip()
+		}(i)
+	}
+	wg.Wait()
+
+	actual := summary.String("uploaded")
+	expected := "uploaded 90, skipped 100, failed 10, 900 B in "
+	if !strings.HasPrefix(actual, expected) {
+		t.Errorf("Expected summary to start with %q, got %q", expected, actual)
+	}
+	if code := summary.exitCode(); code != exitTransferFailed {
+		t.Errorf("Expected exit code %d, got %d", exitTransferFailed, code)
+	}
+	summary.listingError()
+	if code := summary.exitCode(); code != exitListingError {
+		t.Errorf("Expected exit code %d, got %d", exitListingError, code)
+	}
+}
+
+func TestSummaryExitCodes(t *testing.T) {
+	var nilSummary *Summary
+	nilSummary.add(&Result{File: &FileStat{}})
+	if code := nilSummary.exitCode(); code != exitOK {
+		t.Errorf("Expected exit code %d for a nil summary, got %d", exitOK, code)
+	}
+
+	summary := NewSummary()
+	summary.add(&Result{File: &FileStat{}})
+	summary.deleteResult(nil)
+	if !summary.success() {
+		t.Errorf("Expected success, got exit code %d", summary.exitCode())
+	}
+	summary.deleteResult(errors.New("access denied"))
+	if code := summary.exitCode(); code != exitTransferFailed {
+		t.Errorf("Expected exit code %d after a failed delete, got %d", exitTransferFailed, code)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		in       int64
+		expected string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{5 * 1024 * 1024, "5.0 MiB"},
+		{3 * 1024 * 1024 * 1024, "3.0 GiB"},
+	}
+	for _, test := range tests {
+		if actual := formatBytes(test.in); actual != test.expected {
+			t.Errorf("formatBytes(%d) => %q, want %q", test.in, actual, test.expected)
+		}
+	}
+}
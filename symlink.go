@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// metaSymlinkTarget is the metadata with the target of a symbolic link that was uploaded as a link
+const metaSymlinkTarget = "symlink-target"
+
+// SymlinkPolicy decides what happens with symbolic links in the local directory
+type SymlinkPolicy int
+
+const (
+	// FollowSymlinks syncs the files and directories that links point to as if they were in the place of the link
+	FollowSymlinks SymlinkPolicy = iota
+	// SkipSymlinks leaves links out of the sync
+	SkipSymlinks
+	// SymlinkMetadata uploads links as empty objects with the target in their metadata, downloads recreate the links
+	SymlinkMetadata
+)
+
+func (p SymlinkPolicy) String() string {
+	switch p {
+	case SkipSymlinks:
+		return "skip"
+	case SymlinkMetadata:
+		return "metadata"
+	}
+	return "follow"
+}
+
+// parseSymlinkPolicy returns the policy from the -symlinks flag and the -follow-symlinks and -no-follow-symlinks flags,
+// that can't contradict each other
+func parseSymlinkPolicy(value string, follow, noFollow bool) (SymlinkPolicy, error) {
+	policy := FollowSymlinks
+	switch value {
+	case "", "follow":
+	case "skip":
+		policy = SkipSymlinks
+	case "metadata":
+		policy = SymlinkMetadata
+	default:
+		return policy, fmt.Errorf("-symlinks must be skip, follow or metadata, not '%s'", value)
+	}
+	switch {
+	case follow && noFollow:
+		return policy, fmt.Errorf("-follow-symlinks and -no-follow-symlinks can't be used together")
+	case follow && value != "" && policy != FollowSymlinks:
+		return policy, fmt.Errorf("-follow-symlinks can't be used with -symlinks %s", policy)
+	case noFollow && value != "" && policy != SkipSymlinks:
+		return policy, fmt.Errorf("-no-follow-symlinks can't be used with -symlinks %s", policy)
+	case noFollow:
+		policy = SkipSymlinks
+	}
+	return policy, nil
+}
+
+// uploadSymlink uploads a link as an empty object with the target of the link in its metadata
+func uploadSymlink(config *Config, fileStat *FileStat, logger *Logger) error {
+
+	logger.Debug.Printf("will upload the link %s -> %s to s3://%s/%s\n", fileStat.Path, fileStat.LinkTarget, config.Bucket, config.BucketPrefix)
+
+	if config.DryRun {
+		return nil
+	}
+
+	params := &s3manager.UploadInput{
+		Bucket: aws.String(config.Bucket),
+		Key:    aws.String(objectKey(config.BucketPrefix, fileStat.Name)),
+		Body:   bytes.NewReader(nil),
+		Metadata: map[string]*string{
+			metaSymlinkTarget: aws.String(fileStat.LinkTarget),
+			metaMtime:         aws.String(formatMtime(fileStat.ModTime)),
+		},
+	}
+	setObjectHeaders(params, config.Rules.match(fileStat.Name), time.Now())
+	config.Encryption.setUpload(params)
+	_, err := s3manager.NewUploaderWithClient(config.S3Service).Upload(params)
+	return err
+}
+
+// symlinkTarget returns the target of a link that was uploaded as a link, or "" for other objects
+func symlinkTarget(file *FileStat) string {
+	return file.Metadata[metaSymlinkTarget]
+}
+
+// createSymlink replaces the file at path with a link to target. Absolute targets and targets that points outside of
+// basePath are refused, since files that are downloaded later could be written through the link.
+func createSymlink(basePath, path, target string) error {
+	absBase, err := filepath.Abs(basePath)
+	if err != nil {
+		return err
+	}
+	resolved, err := filepath.Abs(filepath.Join(filepath.Dir(path), filepath.FromSlash(target)))
+	if err != nil {
+		return err
+	}
+	if filepath.IsAbs(filepath.FromSlash(target)) || resolved != absBase && !strings.HasPrefix(resolved, absBase+string(filepath.Separator)) {
+		return fmt.Errorf("refusing to create the link %s pointing to '%s' outside of %s", path, target, basePath)
+	}
+
+	// the link is created next to the path and renamed, like downloaded files, so a failure never removes the file
+	tmp := filepath.Join(filepath.Dir(path), ".s3sync-link-"+filepath.Base(path))
+	_ = os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSymlinkPolicy(t *testing.T) {
+	tests := []struct {
+		value            string
+		follow, noFollow bool
+		expected         SymlinkPolicy
+		err              bool
+	}{
+		{expected: FollowSymlinks},
+		{value: "skip", expected: SkipSymlinks},
+		{value: "metadata", expected: SymlinkMetadata},
+		{follow: true, expected: FollowSymlinks},
+		{noFollow: true, expected: SkipSymlinks},
+		{value: "skip", noFollow: true, expected: SkipSymlinks},
+		{value: "follow", follow: true, expected: FollowSymlinks},
+		{value: "copy", err: true},
+		{follow: true, noFollow: true, err: true},
+		{value: "metadata", follow: true, err: true},
+		{value: "metadata", noFollow: true, err: true},
+	}
+	for _, test := range tests {
+		policy, err := parseSymlinkPolicy(test.value, test.follow, test.noFollow)
+		if test.err {
+			if err == nil {
+				t.Errorf("%+v: expected an error", test)
+			}
+			continue
+		}
+		if err != nil || policy != test.expected {
+			t.Errorf("%+v: expected %s, got %s and %v", test, test.expected, policy, err)
+		}
+	}
+}
+
+// symlinkTestDir creates a release layout with a link to the current release, links that loops and a broken link
+func symlinkTestDir(t *testing.T) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("symbolic links needs extra privileges on windows")
+	}
+	dir, err := ioutil.TempDir("", "s3sync-symlinks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := filepath.Join(dir, "releases", "123")
+	if err := os.MkdirAll(release, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(release, "index.html"), []byte("<h1>123</h1>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"current":                "releases/123",
+		"releases/123/self":      ".",
+		"releases/123/up":        "../..",
+		"releases/123/broken":    "missing.html",
+		"releases/123/latest.js": "index.html",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadLocalFilesSymlinks(t *testing.T) {
+	dir := symlinkTestDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	tests := map[SymlinkPolicy][]string{
+		SkipSymlinks:    {"releases/123/index.html"},
+		FollowSymlinks:  {"current/index.html", "current/latest.js", "releases/123/index.html", "releases/123/latest.js"},
+		SymlinkMetadata: {"current", "releases/123/broken", "releases/123/index.html", "releases/123/latest.js", "releases/123/self", "releases/123/up"},
+	}
+	for policy, expected := range tests {
+		logger, buf := getTestLogger()
+		files := sink(loadLocalFiles(dir, nil, policy, nil, logger))
+		var names []string
+		for name := range files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if strings.Join(names, ",") != strings.Join(expected, ",") {
+			t.Errorf("%s: expected %v, got %v\n%s", policy, expected, names, buf)
+		}
+
+		switch policy {
+		case FollowSymlinks:
+			if files["current/latest.js"].Size != 12 {
+				t.Errorf("expected the followed link to have the size of the target, got %d", files["current/latest.js"].Size)
+			}
+			for _, message := range []string{"broken link releases/123/broken", "link releases/123/self", "link releases/123/up"} {
+				if !strings.Contains(buf.String(), message) {
+					t.Errorf("expected the log to mention '%s', got %s", message, buf)
+				}
+			}
+		case SymlinkMetadata:
+			if file := files["current"]; file.LinkTarget != "releases/123" || file.Size != 0 {
+				t.Errorf("expected an empty file with the link target, got %+v", file)
+			}
+			if file := files["releases/123/index.html"]; file.LinkTarget != "" {
+				t.Errorf("expected a file that isn't a link to have no target, got %s", file.LinkTarget)
+			}
+		}
+	}
+}
+
+func TestCreateSymlink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symbolic links needs extra privileges on windows")
+	}
+	dir, err := ioutil.TempDir("", "s3sync-symlinks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	if err := os.MkdirAll(filepath.Join(dir, "releases", "123"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// an existing file is replaced by the link
+	current := filepath.Join(dir, "current")
+	if err := ioutil.WriteFile(current, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := createSymlink(dir, current, "releases/123"); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := os.Readlink(current); err != nil || target != "releases/123" {
+		t.Errorf("expected a link to releases/123, got '%s' and %v", target, err)
+	}
+
+	// links that would let later downloads write outside of the directory are refused
+	releases := filepath.Join(dir, "releases")
+	for _, target := range []string{"/etc", "..", "123/../../etc"} {
+		if err := createSymlink(releases, filepath.Join(releases, "link"), target); err == nil {
+			t.Errorf("expected the link to '%s' to be refused", target)
+		}
+	}
+	if err := createSymlink(releases, filepath.Join(releases, "link"), "123/../123"); err != nil {
+		t.Errorf("expected a link inside the directory to be created, got %v", err)
+	}
+}
+
+func TestShouldSyncLinks(t *testing.T) {
+	keys, _ := newLocalKeyWrapper(bytes.Repeat([]byte{42}, dataKeySize))
+	compress := &ObjectRules{}
+	compress.add(&ObjectRule{Pattern: "*", Compress: compressGzip})
+	if err := compress.compile(globOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	local := &FileStat{Name: "current", Path: "/var/www/current", ModTime: now.Add(-time.Hour), LinkTarget: "releases/123"}
+	link := map[string]string{metaSymlinkTarget: "releases/123"}
+
+	// links are uploaded as empty objects that aren't encrypted or compressed, so they aren't uploaded again for that
+	tests := []struct {
+		config   *Config
+		metadata map[string]string
+		expected bool
+	}{
+		{config: &Config{Mode: Upload, Symlinks: SymlinkMetadata, ClientEncryption: keys}},
+		{config: &Config{Mode: Upload, Symlinks: SymlinkMetadata, ClientEncryption: keys}, metadata: link},
+		{config: &Config{Mode: Upload, Symlinks: SymlinkMetadata, Rules: compress}, metadata: link},
+		{config: &Config{Mode: Upload, Symlinks: SymlinkMetadata, ClientEncryption: keys}, metadata: map[string]string{}, expected: true},
+	}
+	for i, test := range tests {
+		remote := &FileStat{Name: "current", Path: "www/current", ModTime: now, ETag: "d41d8cd98f00b204e9800998ecf8427e", Metadata: test.metadata}
+		if needed, reason := shouldSync(test.config, defaultStrategy{}, local, remote); needed != test.expected {
+			t.Errorf("test %d: expected %v, got %v with %s", i, test.expected, needed, reason)
+		}
+	}
+}
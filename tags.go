@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// The limits s3 has for object tags
+const (
+	maxTags           = 10
+	maxTagKeyLength   = 128
+	maxTagValueLength = 256
+)
+
+// splitTag splits a tag in the format KEY=VALUE, a tag without a '=' has an empty value
+func splitTag(tag string) (string, string) {
+	if i := strings.Index(tag, "="); i >= 0 {
+		return tag[:i], tag[i+1:]
+	}
+	return tag, ""
+}
+
+// validateTags returns an error if there are more tags than s3 allows or a key or value is too long
+func validateTags(tags map[string]string) error {
+	if len(tags) > maxTags {
+		return fmt.Errorf("an object can have at most %d tags", maxTags)
+	}
+	for key, value := range tags {
+		if key == "" {
+			return fmt.Errorf("tag without a key")
+		}
+		if len(key) > maxTagKeyLength || len(value) > maxTagValueLength {
+			return fmt.Errorf("the tag '%s' is too long, keys can be %d and values %d characters", key, maxTagKeyLength, maxTagValueLength)
+		}
+	}
+	return nil
+}
+
+// encodeTags encodes tags as url query parameters sorted by key, the format of the x-amz-tagging header
+func encodeTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	encoded := make([]string, len(keys))
+	for i, key := range keys {
+		encoded[i] = tagEscape(key) + "=" + tagEscape(tags[key])
+	}
+	return strings.Join(encoded, "&")
+}
+
+// tagEscape escapes spaces as %20 instead of '+', which s3 would keep as a '+'
+func tagEscape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+// tagMultipartUpload sets the tags of an upload that was done in parts. CreateMultipartUpload in the vendored sdk
+// can't set tags, so they are set when the upload is complete.
+func tagMultipartUpload(config *Config, params *s3manager.UploadInput) error {
+	if params.Tagging == nil {
+		return nil
+	}
+	query, err := url.ParseQuery(*params.Tagging)
+	if err != nil {
+		return err
+	}
+	tagging := &s3.Tagging{}
+	for key, values := range query {
+		tagging.TagSet = append(tagging.TagSet, &s3.Tag{Key: aws.String(key), Value: aws.String(values[0])})
+	}
+	_, err = config.S3Service.PutObjectTagging(&s3.PutObjectTaggingInput{
+		Bucket:  params.Bucket,
+		Key:     params.Key,
+		Tagging: tagging,
+	})
+	return err
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+func TestTagRules(t *testing.T) {
+	rules := &ObjectRules{}
+	flag := &ruleFlag{rules: rules, set: func(r *ObjectRule, v string) {
+		key, value := splitTag(v)
+		r.Tags = map[string]string{key: value}
+	}}
+	for _, value := range []string{"logs/**=retention=90d", "logs/audit/**=retention=7y", "**/*.csv=content=report data"} {
+		if err := flag.Set(value); err != nil {
+			t.Fatalf("Set(%q) failed: %v", value, err)
+		}
+	}
+	if err := flag.Set("*.txt==value"); err == nil {
+		t.Error("expected an error for a tag without a key")
+	}
+	if err := flag.Set("*.txt=" + strings.Repeat("k", maxTagKeyLength+1)); err == nil {
+		t.Error("expected an error for a key that is too long")
+	}
+	rules.addDefault(&ObjectRule{Pattern: "**", Tags: map[string]string{"team": "web", "retention": "30d"}})
+	if err := rules.compile(globOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		expected map[string]string
+	}{
+		{name: "index.html", expected: map[string]string{"team": "web", "retention": "30d"}},
+		{name: "logs/access.log", expected: map[string]string{"team": "web", "retention": "90d"}},
+		{name: "logs/audit/2020.csv", expected: map[string]string{"team": "web", "retention": "7y", "content": "report data"}},
+	}
+	for _, test := range tests {
+		if actual := rules.match(test.name).Tags; !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("match(%q).Tags => %v, want %v", test.name, actual, test.expected)
+		}
+	}
+
+	params := &s3manager.UploadInput{}
+	setObjectHeaders(params, rules.match("logs/audit/2020.csv"), time.Now())
+	if expected := "content=report%20data&retention=7y&team=web"; aws.StringValue(params.Tagging) != expected {
+		t.Errorf("Tagging is %q, want %q", aws.StringValue(params.Tagging), expected)
+	}
+
+	// every rule is valid on its own, but a file matching all of them would get too many tags
+	for i := 0; i < maxTags-2; i++ {
+		if err := flag.Set(fmt.Sprintf("logs/**=key%d=value", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rules.compile(globOptions{}); err == nil {
+		t.Errorf("expected an error for rules with %d tag keys together", maxTags+1)
+	}
+}
+
+// taggingMock records the tags that are set with PutObjectTagging
+type taggingMock struct {
+	s3iface.S3API
+	input *s3.PutObjectTaggingInput
+}
+
+func (m *taggingMock) PutObjectTagging(input *s3.PutObjectTaggingInput) (*s3.PutObjectTaggingOutput, error) {
+	m.input = input
+	return &s3.PutObjectTaggingOutput{}, nil
+}
+
+func TestTagMultipartUpload(t *testing.T) {
+	mock := &taggingMock{}
+	config := &Config{S3Service: mock}
+	params := &s3manager.UploadInput{Bucket: aws.String("bucket"), Key: aws.String("www/big.tar")}
+	if err := tagMultipartUpload(config, params); err != nil || mock.input != nil {
+		t.Fatalf("expected no tagging without tags, got %v", err)
+	}
+
+	params.Tagging = aws.String(encodeTags(map[string]string{"team": "web", "note": "a&b c"}))
+	if err := tagMultipartUpload(config, params); err != nil {
+		t.Fatal(err)
+	}
+	tags := make(map[string]string)
+	for _, tag := range mock.input.Tagging.TagSet {
+		tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	if expected := map[string]string{"team": "web", "note": "a&b c"}; !reflect.DeepEqual(tags, expected) {
+		t.Errorf("tagged with %v, want %v", tags, expected)
+	}
+}
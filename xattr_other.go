@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// xattrsSupported is true on the platforms where extended attributes can be read and written
+const xattrsSupported = false
+
+func listXattrs(path string) ([]string, error) {
+	return nil, errXattrsNotSupported
+}
+
+func getXattr(path, name string) ([]byte, error) {
+	return nil, errXattrsNotSupported
+}
+
+func setXattr(path, name string, value []byte) error {
+	return errXattrsNotSupported
+}